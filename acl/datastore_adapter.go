@@ -160,6 +160,9 @@ type DatastoreAdapter struct {
 	RoleNodesKind,
 	ResourceNodesKind,
 	RulesKind string
+	// NewRepository creates the repositories of the ACL kinds,
+	// datastore.NewDefaultRepository is used if nil
+	NewRepository func(ctx context.Context, kind string) datastore.Repository
 }
 
 const (
@@ -181,10 +184,17 @@ func NewDatastoreAdapterWithACL(ctx context.Context, ACL *tiger_acl.ACL) *Datast
 	return adapter
 }
 func (adapter DatastoreAdapter) Save() error { return nil }
+
+func (adapter DatastoreAdapter) repository(kind string) datastore.Repository {
+	if adapter.NewRepository != nil {
+		return adapter.NewRepository(adapter.ctx, kind)
+	}
+	return datastore.NewDefaultRepository(adapter.ctx, kind)
+}
 func (adapter DatastoreAdapter) Load() error {
-	roleTreeRepository := datastore.NewDefaultRepository(adapter.ctx, adapter.RoleNodesKind)
-	resourceTreeRepository := datastore.NewDefaultRepository(adapter.ctx, adapter.ResourceNodesKind)
-	ruleRepository := datastore.NewDefaultRepository(adapter.ctx, adapter.RulesKind)
+	roleTreeRepository := adapter.repository(adapter.RoleNodesKind)
+	resourceTreeRepository := adapter.repository(adapter.ResourceNodesKind)
+	ruleRepository := adapter.repository(adapter.RulesKind)
 	// Roles
 	roleNodes := []*RoleNode{}
 	if err := roleTreeRepository.FindAll(&roleNodes); err != nil {
@@ -19,6 +19,7 @@ import (
 
 	"github.com/Mparaiso/appengine/acl"
 	appengine_datastore "github.com/Mparaiso/appengine/datastore"
+	_ "github.com/Mparaiso/appengine/datastore/datastoretest"
 	tiger_acl "github.com/Mparaiso/go-tiger/acl"
 	"github.com/Mparaiso/go-tiger/test"
 	"golang.org/x/net/context"
@@ -68,3 +69,24 @@ func TestDatastoreAdapter_Load(t *testing.T) {
 	test.Error(t, adapter.ACL.IsAllowed(tiger_acl.NewRole("guest"), tiger_acl.NewResource("page")), false)
 
 }
+
+// Given an adapter using in-memory repositories
+// When rules are loaded
+// It should not need a datastore
+func TestDatastoreAdapter_Load_InMemory(t *testing.T) {
+	store := appengine_datastore.NewMemoryStore()
+	newRepository := func(ctx context.Context, kind string) appengine_datastore.Repository {
+		repository := appengine_datastore.NewInMemoryRepository(ctx, kind)
+		repository.Store = store
+		return repository
+	}
+	ctx := context.Background()
+	test.Fatal(t, newRepository(ctx, acl.RoleNodesKind).Create(&acl.RoleNode{RoleID: "guest"}), nil)
+	test.Fatal(t, newRepository(ctx, acl.ResourceNodesKind).Create(&acl.ResourceNode{ResourceID: "article"}), nil)
+	test.Fatal(t, newRepository(ctx, acl.RulesKind).Create(&acl.Rule{Type: tiger_acl.Allow, RoleID: "guest", Privilege: "read", ResourceID: "article"}), nil)
+
+	adapter := acl.NewDatastoreAdapter(ctx)
+	adapter.NewRepository = newRepository
+	test.Fatal(t, adapter.Load(), nil)
+	test.Error(t, adapter.ACL.IsAllowed(tiger_acl.NewRole("guest"), tiger_acl.NewResource("article"), "delete"), false)
+}
@@ -0,0 +1,282 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package audit records the changes made to entities by repositories.
+//
+// A Trail listens to the After* events of a repository signal and stores
+// an audit record for each change, as a child of the changed entity :
+//
+//	trail := audit.NewTrail()
+//	repository.Signal.Add(trail)
+//	// later
+//	records, err := trail.History(ctx, repository.Key(article))
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Mparaiso/appengine/datastore"
+	"golang.org/x/net/context"
+	appengine_datastore "google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// Kind is the datastore kind of audit records
+const Kind = "audit_log"
+
+// Action is the kind of change of a record
+type Action string
+
+const (
+	Created  Action = "created"
+	Updated  Action = "updated"
+	Deleted  Action = "deleted"
+	Restored Action = "restored"
+)
+
+var (
+	ErrNotAnObject = fmt.Errorf("An audited entity must be encoded as a JSON object")
+)
+
+// Change is the change of a field, Old and New are JSON encoded values,
+// empty when the field has no value
+type Change struct {
+	Field string
+	Old   string `datastore:",noindex"`
+	New   string `datastore:",noindex"`
+}
+
+// Record is an audit record, stored as a child of the key of the changed entity
+type Record struct {
+	ID int64
+	// Entity is the key of the changed entity
+	Entity  *appengine_datastore.Key
+	Action  Action
+	Actor   string
+	Changes []Change
+	Created time.Time
+}
+
+// GetID returns a int64
+func (record Record) GetID() int64 {
+	return record.ID
+}
+
+// SetID sets *Record.ID
+func (record *Record) SetID(ID int64) {
+	record.ID = ID
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx carrying the actor of the changes made with it
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set with WithActor, or the email
+// of the signed in App Engine user, or an empty string
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	if u := user.Current(ctx); u != nil {
+		return u.Email
+	}
+	return ""
+}
+
+// Trail is a datastore.Listener recording the changes of the
+// entities of the After* events in audit records
+type Trail struct {
+	// NewRepository creates the repositories of the records,
+	// datastore.NewDefaultRepository is used if nil
+	NewRepository func(ctx context.Context, kind string) datastore.Repository
+	// Actor returns the actor of the changes made with a context, ActorFromContext is used if nil
+	Actor func(ctx context.Context) string
+	// Ignored lists the JSON fields left out of the changes, such as "Updated"
+	Ignored []string
+}
+
+// NewTrail creates a Trail, ignored lists the JSON fields left out of the changes
+func NewTrail(ignored ...string) *Trail {
+	return &Trail{Ignored: ignored}
+}
+
+// GetActor returns trail.Actor or ActorFromContext
+func (trail Trail) GetActor() func(ctx context.Context) string {
+	if trail.Actor == nil {
+		return ActorFromContext
+	}
+	return trail.Actor
+}
+
+// repository returns a repository of the records of the entity of key
+func (trail Trail) repository(ctx context.Context, key *appengine_datastore.Key) (datastore.Repository, error) {
+	var repository datastore.Repository
+	if trail.NewRepository != nil {
+		repository = trail.NewRepository(ctx, Kind)
+	} else {
+		repository = datastore.NewDefaultRepository(ctx, Kind)
+	}
+	setter, ok := repository.(datastore.ParentKeySetter)
+	if !ok {
+		return nil, fmt.Errorf("The repository of the audit records must be a datastore.ParentKeySetter")
+	}
+	setter.SetParentKey(key)
+	return repository, nil
+}
+
+// Handle records the changes of After* events, other events are ignored.
+// The entities of After* events are already written, the records that cannot be
+// stored are therefore logged with datastore.Logf instead of failing the writes
+func (trail Trail) Handle(e datastore.Event) error {
+	var (
+		ctx      context.Context
+		key      *appengine_datastore.Key
+		action   Action
+		old, new interface{}
+	)
+	switch event := e.(type) {
+	case datastore.AfterEntityCreatedEvent:
+		ctx, key, action, new = event.Context, event.Key, Created, event.Entity
+	case datastore.AfterEntityUpdatedEvent:
+		ctx, key, action, old, new = event.Context, event.Key, Updated, event.Old, event.New
+	case datastore.AfterEntityDeletedEvent:
+		ctx, key, action, old = event.Context, event.Key, Deleted, event.Entity
+	case datastore.AfterEntityRestoredEvent:
+		ctx, key, action = event.Context, event.Key, Restored
+	default:
+		return nil
+	}
+	if key == nil || key.Kind() == Kind {
+		return nil
+	}
+	if err := trail.record(ctx, key, action, old, new); err != nil {
+		datastore.Logf(ctx, "The %s change of %s is not audited : %s", action, key, err)
+	}
+	return nil
+}
+
+// record stores the record of a change of the entity of key
+func (trail Trail) record(ctx context.Context, key *appengine_datastore.Key, action Action, old, new interface{}) error {
+	changes, err := Diff(old, new, trail.Ignored...)
+	if err != nil {
+		return err
+	}
+	repository, err := trail.repository(ctx, key)
+	if err != nil {
+		return err
+	}
+	return repository.Create(&Record{
+		Entity:  key,
+		Action:  action,
+		Actor:   trail.GetActor()(ctx),
+		Changes: changes,
+		Created: time.Now(),
+	})
+}
+
+// History returns the records of the entity of key, oldest first
+func (trail Trail) History(ctx context.Context, key *appengine_datastore.Key) ([]*Record, error) {
+	repository, err := trail.repository(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	records := []*Record{}
+	// records of the descendants of the entity are filtered out, the records are sorted
+	// once loaded since sorting an ancestor query with a filter needs a composite index
+	query := datastore.Where("Entity", datastore.Eq, key)
+	if err = repository.FindBy(query, &records); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Created.Before(records[j].Created)
+	})
+	return records, nil
+}
+
+// Diff returns the changes of the JSON fields of old and new, sorted by field.
+// old is nil for a created entity, new is nil for a deleted entity.
+// Fields hidden from JSON, such as passwords, are never recorded.
+func Diff(old, new interface{}, ignored ...string) ([]Change, error) {
+	oldFields, err := fields(old)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := fields(new)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range oldFields {
+		names = append(names, name)
+	}
+	for name := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changes := []Change{}
+	for _, name := range names {
+		if contains(ignored, name) {
+			continue
+		}
+		if o, n := oldFields[name], newFields[name]; !bytes.Equal(o, n) {
+			changes = append(changes, Change{Field: name, Old: string(o), New: string(n)})
+		}
+	}
+	return changes, nil
+}
+
+// fields returns the compacted JSON values of the fields of value
+func fields(value interface{}) (map[string][]byte, error) {
+	result := map[string][]byte{}
+	if value == nil {
+		return result, nil
+	}
+	document, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(document, []byte("null")) {
+		return result, nil
+	}
+	raw := map[string]json.RawMessage{}
+	if err = json.Unmarshal(document, &raw); err != nil {
+		return nil, ErrNotAnObject
+	}
+	for name, value := range raw {
+		compacted := new(bytes.Buffer)
+		if err = json.Compact(compacted, value); err != nil {
+			return nil, err
+		}
+		result[name] = compacted.Bytes()
+	}
+	return result, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package audit_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mparaiso/appengine/audit"
+	"github.com/Mparaiso/appengine/datastore"
+	_ "github.com/Mparaiso/appengine/datastore/datastoretest"
+	"github.com/Mparaiso/appengine/utils"
+	"github.com/Mparaiso/go-tiger/test"
+	"golang.org/x/net/context"
+)
+
+type Article struct {
+	ID       int64
+	Title    string
+	Body     string
+	Password string `json:"-"`
+}
+
+// GetID returns a int64
+func (article Article) GetID() int64 {
+	return article.ID
+}
+
+// SetID sets *Article.ID
+func (article *Article) SetID(ID int64) {
+	article.ID = ID
+}
+
+func actions(records []*audit.Record) string {
+	result := []string{}
+	for _, record := range records {
+		result = append(result, string(record.Action))
+	}
+	return strings.Join(result, ",")
+}
+
+// newTrail returns a trail storing records in store
+func newTrail(store *datastore.MemoryStore) *audit.Trail {
+	trail := audit.NewTrail()
+	trail.NewRepository = func(ctx context.Context, kind string) datastore.Repository {
+		repository := datastore.NewInMemoryRepository(ctx, kind)
+		repository.Store = store
+		return repository
+	}
+	return trail
+}
+
+// Given two versions of an entity
+// When they are compared
+// It should return the changed fields
+// It should leave out ignored fields and fields hidden from JSON
+func TestDiff(t *testing.T) {
+	changes, err := audit.Diff(&Article{ID: 1, Title: "Title", Body: "Body", Password: "secret"}, &Article{ID: 1, Title: "New title", Body: "New body", Password: "new secret"}, "Body")
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(changes), 1)
+	test.Error(t, changes[0], audit.Change{Field: "Title", Old: `"Title"`, New: `"New title"`})
+
+	changes, err = audit.Diff(nil, &Article{ID: 1, Title: "Title"})
+	test.Fatal(t, err, nil)
+	test.Error(t, len(changes), 3, "every field of a created entity should be recorded")
+	_, err = audit.Diff(nil, "not an object")
+	test.Error(t, err, audit.ErrNotAnObject)
+}
+
+// Given a repository dispatching events to a Trail
+// When an entity is created, updated and deleted
+// Its history should list the changes with their actor
+func TestTrail(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	trail := newTrail(store)
+	ctx := audit.WithActor(context.Background(), "johndoe")
+	repository := datastore.NewInMemoryRepository(ctx, "articles", trail)
+	repository.Store = store
+	article := &Article{Title: "Title"}
+	other := &Article{Title: "Other"}
+	test.Fatal(t, repository.CreateMulti(article, other), nil)
+	article.Title = "New title"
+	test.Fatal(t, repository.Update(article), nil)
+	test.Fatal(t, repository.Delete(article), nil)
+
+	records, err := trail.History(ctx, repository.Key(article))
+	test.Fatal(t, err, nil)
+	test.Fatal(t, actions(records), "created,updated,deleted")
+	test.Error(t, records[1].Actor, "johndoe")
+	test.Error(t, records[1].Entity.Equal(repository.Key(article)), true)
+	test.Fatal(t, len(records[1].Changes), 1)
+	test.Error(t, records[1].Changes[0], audit.Change{Field: "Title", Old: `"Title"`, New: `"New title"`})
+
+	records, err = trail.History(ctx, repository.Key(other))
+	test.Fatal(t, err, nil)
+	test.Error(t, actions(records), "created")
+}
+
+// Given records stored out of order
+// When the history of their entity is listed
+// It should be sorted by creation time
+func TestTrail_History_Order(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	trail := newTrail(store)
+	ctx := context.Background()
+	articles := datastore.NewInMemoryRepository(ctx, "articles")
+	articles.Store = store
+	article := &Article{Title: "Title"}
+	test.Fatal(t, articles.Create(article), nil)
+	key := articles.Key(article)
+	records := datastore.NewInMemoryRepository(ctx, audit.Kind)
+	records.Store = store
+	records.SetParentKey(key)
+	now := time.Now()
+	test.Fatal(t, records.CreateMulti(
+		&audit.Record{Entity: key, Action: audit.Updated, Created: now},
+		&audit.Record{Entity: key, Action: audit.Created, Created: now.Add(-time.Hour)},
+	), nil)
+
+	history, err := trail.History(ctx, key)
+	test.Fatal(t, err, nil)
+	test.Error(t, actions(history), "created,updated")
+}
+
+// unscopedRepository is a repository that cannot store records as children of entities
+type unscopedRepository struct {
+	datastore.Repository
+}
+
+// Given a Trail that cannot store records
+// When an entity is created
+// It should be created and the failure should be logged
+func TestTrail_Failure(t *testing.T) {
+	logs := []string{}
+	defer func(logf func(context.Context, string, ...interface{})) { datastore.Logf = logf }(datastore.Logf)
+	datastore.Logf = func(ctx context.Context, format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	trail := audit.NewTrail()
+	trail.NewRepository = func(ctx context.Context, kind string) datastore.Repository {
+		return unscopedRepository{datastore.NewInMemoryRepository(ctx, kind)}
+	}
+	repository := datastore.NewInMemoryRepository(context.Background(), "articles", trail)
+	article := &Article{Title: "Title"}
+	test.Fatal(t, repository.Create(article), nil)
+	test.Error(t, repository.FindByID(article.ID, &Article{}), nil)
+	test.Fatal(t, len(logs), 1)
+	test.Error(t, strings.Contains(logs[0], "created"), true)
+}
+
+// Given a resource and its mounted history endpoint
+// When an entity is created and patched
+// The endpoint should list its history
+func TestTrail_Mount(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	trail := newTrail(store)
+	resource := utils.NewResource(&Article{}, "articles")
+	resource.GetSignal().Add(trail)
+	resource.ContextFactory = datastore.ContextFactoryFunc(func(r *http.Request) context.Context {
+		return audit.WithActor(context.Background(), r.Header.Get("X-User"))
+	})
+	resource.RepositoryFactory = func(r *http.Request) (datastore.Repository, error) {
+		repository := datastore.NewInMemoryRepositoryWithSignal(resource.Context(r), resource.Kind, resource.GetSignal())
+		repository.Store = store
+		return repository, nil
+	}
+	mux := http.NewServeMux()
+	resource.Mount(mux, "/articles")
+	trail.Mount(mux, "/articles", resource)
+
+	request := httptest.NewRequest("POST", "/articles", bytes.NewBufferString(`{"Title":"Title"}`))
+	request.Header.Set("X-User", "johndoe")
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	test.Fatal(t, response.Code, http.StatusCreated)
+	message := &utils.CreatedMessage{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(message), nil)
+
+	request = httptest.NewRequest("PATCH", fmt.Sprintf("/articles/%d", message.ID), bytes.NewBufferString(`{"Body":"Body"}`))
+	request.Header.Set("Content-Type", utils.MergePatchContentType)
+	request.Header.Set("X-User", "janedoe")
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	test.Fatal(t, response.Code, http.StatusOK)
+
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest("GET", fmt.Sprintf("/articles/%d/history", message.ID), nil))
+	test.Fatal(t, response.Code, http.StatusOK)
+	history := &audit.HistoryMessage{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(history), nil)
+	test.Fatal(t, actions(history.Items), "created,updated")
+	test.Error(t, history.Items[0].Actor, "johndoe")
+	test.Error(t, history.Items[1].Actor, "janedoe")
+
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest("GET", "/articles/abc/history", nil))
+	test.Error(t, response.Code, http.StatusBadRequest)
+}
@@ -0,0 +1,56 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Mparaiso/appengine/utils"
+)
+
+// HistoryMessage is returned by the history endpoint
+type HistoryMessage struct {
+	Items []*Record
+}
+
+// HistoryHandler returns a handler listing the records of the entity of a request
+// to resource, the entity is identified like in the handlers of the resource
+func (trail *Trail) HistoryHandler(resource *utils.Resource) http.HandlerFunc {
+	fail := resource.GetErrorFunction()
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := resource.Key(r)
+		if err != nil {
+			fail(w, err, utils.StatusOf(err, http.StatusBadRequest))
+			return
+		}
+		records, err := trail.History(resource.Context(r), key)
+		if err != nil {
+			fail(w, err, utils.StatusOf(err, http.StatusInternalServerError))
+			return
+		}
+		if err = json.NewEncoder(w).Encode(HistoryMessage{Items: records}); err != nil {
+			fail(w, err, http.StatusInternalServerError)
+		}
+	}
+}
+
+// Mount registers the history endpoint of resource on mux, next to the routes of resource.Mount :
+//
+//	GET prefix/{kind}/history
+func (trail *Trail) Mount(mux *http.ServeMux, prefix string, resource *utils.Resource) {
+	mux.HandleFunc("GET "+strings.TrimSuffix(prefix, "/")+"/{"+resource.Kind+"}/history", trail.HistoryHandler(resource))
+}
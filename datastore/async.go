@@ -0,0 +1,367 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	// DefaultMaxRetries is the number of retries of a failed event when AsyncSignal.MaxRetries is 0
+	DefaultMaxRetries = 5
+	// DefaultRetryDelay is the delay before the first retry of a failed event when AsyncSignal.RetryDelay is 0
+	DefaultRetryDelay = 10 * time.Second
+)
+
+var (
+	ErrUnregisteredEntity = fmt.Errorf("The entity type of the event is not registered")
+	ErrUnknownEvent       = fmt.Errorf("The event type of the message is unknown")
+)
+
+// EventMessage is the serialized form of an After* event.
+// Entities are encoded in JSON, fields hidden from JSON are not replayed
+type EventMessage struct {
+	// Event is the name of the event type, such as AfterEntityCreatedEvent
+	Event string
+	// Type is the registered name of the entity type
+	Type string
+	// Entity is the entity of the event, the new entity of an AfterEntityUpdatedEvent
+	Entity json.RawMessage
+	// Key is the encoded key of the entity
+	Key string `json:",omitempty"`
+	// Old is the old entity of an AfterEntityUpdatedEvent
+	Old json.RawMessage `json:",omitempty"`
+	// Attempts is the number of failed dispatches
+	Attempts int
+	// Error is the error of the last failed dispatch
+	Error string `json:",omitempty"`
+	// Delay is the delay before the message is replayed
+	Delay time.Duration `json:"-"`
+}
+
+// Queue enqueues event messages
+type Queue interface {
+	Enqueue(ctx context.Context, message *EventMessage) error
+}
+
+// TaskQueue enqueues event messages in an App Engine push queue
+type TaskQueue struct {
+	// Name is the name of the queue, the default queue if empty
+	Name string
+	// Path is the path the AsyncSignal is mounted on
+	Path string
+}
+
+// Enqueue adds a task posting the message to Path
+func (queue TaskQueue) Enqueue(ctx context.Context, message *EventMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	task := &taskqueue.Task{
+		Path:    queue.Path,
+		Payload: payload,
+		Method:  "POST",
+		Header:  http.Header{"Content-Type": []string{"application/json"}},
+		Delay:   message.Delay,
+	}
+	_, err = taskqueue.Add(ctx, task, queue.Name)
+	return err
+}
+
+// InMemoryQueue is an in process queue, mostly useful in tests
+type InMemoryQueue struct {
+	mutex    sync.Mutex
+	messages []*EventMessage
+}
+
+// NewInMemoryQueue creates an InMemoryQueue
+func NewInMemoryQueue() *InMemoryQueue {
+	return &InMemoryQueue{messages: []*EventMessage{}}
+}
+
+// Enqueue appends a copy of message to the queue
+func (queue *InMemoryQueue) Enqueue(ctx context.Context, message *EventMessage) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	copied := *message
+	queue.messages = append(queue.messages, &copied)
+	return nil
+}
+
+// Messages returns the messages in the queue
+func (queue *InMemoryQueue) Messages() []*EventMessage {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return append([]*EventMessage{}, queue.messages...)
+}
+
+// Len returns the number of messages in the queue
+func (queue *InMemoryQueue) Len() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.messages)
+}
+
+// Drain replays the messages to signal until the queue is empty,
+// including the messages enqueued again to be retried, regardless of their delay
+func (queue *InMemoryQueue) Drain(ctx context.Context, signal *AsyncSignal) error {
+	for {
+		queue.mutex.Lock()
+		if len(queue.messages) == 0 {
+			queue.mutex.Unlock()
+			return nil
+		}
+		message := queue.messages[0]
+		queue.messages = queue.messages[1:]
+		queue.mutex.Unlock()
+		if err := signal.Replay(ctx, message); err != nil {
+			return err
+		}
+	}
+}
+
+// AsyncSignal is a Signal dispatching After* events asynchronously.
+// Before* events, which can cancel a write, are dispatched synchronously to the listeners,
+// After* events are serialized and enqueued in Queue, then replayed to the listeners
+// by Replay or ServeHTTP. Listeners of After* events may be called more than once for an event
+// if an other listener fails, since the event is retried.
+// The entity types of the events must be registered: Before* events of unregistered types
+// fail with ErrUnregisteredEntity, which cancels the write, so that no After* event is lost.
+type AsyncSignal struct {
+	*DefaultSignal
+	Queue Queue
+	// DeadLetterQueue receives the messages that failed MaxRetries times, they are dropped if not set
+	DeadLetterQueue Queue
+	// MaxRetries is the number of retries of a failed message, DefaultMaxRetries if 0
+	MaxRetries int
+	// RetryDelay is the delay before the first retry of a failed message, doubled on each retry,
+	// DefaultRetryDelay if 0
+	RetryDelay time.Duration
+	// ContextFactory creates the contexts of ServeHTTP, appengine.NewContext is used if not set
+	ContextFactory ContextFactory
+	types          map[string]reflect.Type
+}
+
+// NewAsyncSignal creates an AsyncSignal, the types of the entities of the events must be registered
+func NewAsyncSignal(queue Queue, prototypes ...Entity) *AsyncSignal {
+	signal := &AsyncSignal{DefaultSignal: NewDefaultSignal(), Queue: queue, types: map[string]reflect.Type{}}
+	signal.Register(prototypes...)
+	return signal
+}
+
+// Register registers the types of entities so that events can be deserialized
+func (signal *AsyncSignal) Register(prototypes ...Entity) {
+	signal.mutex.Lock()
+	defer signal.mutex.Unlock()
+	for _, prototype := range prototypes {
+		t := reflect.Indirect(reflect.ValueOf(prototype)).Type()
+		signal.types[typeName(t)] = t
+	}
+}
+
+// GetMaxRetries returns signal.MaxRetries or DefaultMaxRetries
+func (signal *AsyncSignal) GetMaxRetries() int {
+	if signal.MaxRetries == 0 {
+		return DefaultMaxRetries
+	}
+	return signal.MaxRetries
+}
+
+// GetRetryDelay returns signal.RetryDelay or DefaultRetryDelay
+func (signal *AsyncSignal) GetRetryDelay() time.Duration {
+	if signal.RetryDelay == 0 {
+		return DefaultRetryDelay
+	}
+	return signal.RetryDelay
+}
+
+// typeOf returns the registered type of an entity type name
+func (signal *AsyncSignal) typeOf(name string) (reflect.Type, bool) {
+	signal.mutex.RLock()
+	defer signal.mutex.RUnlock()
+	t, ok := signal.types[name]
+	return t, ok
+}
+
+// Dispatch enqueues After* events and dispatches other events to the listeners.
+// Before* events of unregistered entity types return ErrUnregisteredEntity.
+// After* events are dispatched once the write is done, the events that cannot be enqueued,
+// such as the events of unregistered entity types, are therefore logged and dropped
+func (signal *AsyncSignal) Dispatch(e Event) error {
+	var (
+		ctx         context.Context
+		key         *datastore.Key
+		entity, old Entity
+		message     = &EventMessage{Event: reflect.TypeOf(e).Name()}
+	)
+	switch event := e.(type) {
+	case BeforeEntityCreatedEvent:
+		return signal.dispatchBefore(e, event.Entity)
+	case BeforeEntityUpdatedEvent:
+		return signal.dispatchBefore(e, event.New)
+	case BeforeEntityDeletedEvent:
+		return signal.dispatchBefore(e, event.Entity)
+	case BeforeEntityRestoredEvent:
+		return signal.dispatchBefore(e, event.Entity)
+	case AfterEntityCreatedEvent:
+		ctx, key, entity = event.Context, event.Key, event.Entity
+	case AfterEntityUpdatedEvent:
+		ctx, key, entity, old = event.Context, event.Key, event.New, event.Old
+	case AfterEntityDeletedEvent:
+		ctx, key, entity = event.Context, event.Key, event.Entity
+	case AfterEntityRestoredEvent:
+		ctx, key, entity = event.Context, event.Key, event.Entity
+	default:
+		return signal.DefaultSignal.Dispatch(e)
+	}
+	message.Type = typeName(reflect.Indirect(reflect.ValueOf(entity)).Type())
+	if err := signal.enqueue(ctx, message, key, entity, old); err != nil {
+		Logf(ctx, "%s of %s is not enqueued : %s", message.Event, message.Type, err)
+	}
+	return nil
+}
+
+// enqueue serializes the entities of an After* event into message and enqueues it
+func (signal *AsyncSignal) enqueue(ctx context.Context, message *EventMessage, key *datastore.Key, entity, old Entity) error {
+	if _, ok := signal.typeOf(message.Type); !ok {
+		return ErrUnregisteredEntity
+	}
+	if key != nil {
+		message.Key = key.Encode()
+	}
+	var err error
+	if message.Entity, err = json.Marshal(entity); err != nil {
+		return err
+	}
+	if old != nil {
+		if message.Old, err = json.Marshal(old); err != nil {
+			return err
+		}
+	}
+	return signal.Queue.Enqueue(ctx, message)
+}
+
+// dispatchBefore dispatches a Before* event to the listeners if the type of entity is registered
+func (signal *AsyncSignal) dispatchBefore(e Event, entity Entity) error {
+	if _, ok := signal.typeOf(typeName(reflect.Indirect(reflect.ValueOf(entity)).Type())); !ok {
+		return ErrUnregisteredEntity
+	}
+	return signal.DefaultSignal.Dispatch(e)
+}
+
+// Decode deserializes the event of a message, bound to ctx
+func (signal *AsyncSignal) Decode(ctx context.Context, message *EventMessage) (Event, error) {
+	t, ok := signal.typeOf(message.Type)
+	if !ok {
+		return nil, ErrUnregisteredEntity
+	}
+	entity := reflect.New(t).Interface().(Entity)
+	if err := json.Unmarshal(message.Entity, entity); err != nil {
+		return nil, err
+	}
+	var key *datastore.Key
+	if message.Key != "" {
+		var err error
+		if key, err = datastore.DecodeKey(message.Key); err != nil {
+			return nil, err
+		}
+	}
+	switch message.Event {
+	case "AfterEntityCreatedEvent":
+		return AfterEntityCreatedEvent{Context: ctx, Key: key, Entity: entity}, nil
+	case "AfterEntityUpdatedEvent":
+		old := reflect.New(t).Interface().(Entity)
+		if err := json.Unmarshal(message.Old, old); err != nil {
+			return nil, err
+		}
+		return AfterEntityUpdatedEvent{Context: ctx, Key: key, Old: old, New: entity}, nil
+	case "AfterEntityDeletedEvent":
+		return AfterEntityDeletedEvent{Context: ctx, Key: key, Entity: entity}, nil
+	case "AfterEntityRestoredEvent":
+		return AfterEntityRestoredEvent{Context: ctx, Key: key, Entity: entity}, nil
+	}
+	return nil, ErrUnknownEvent
+}
+
+// Replay dispatches the event of a message to the listeners. If a listener fails,
+// the message is enqueued again with a delay doubled on each retry, starting at RetryDelay,
+// until it failed MaxRetries times, then it is enqueued
+// in the DeadLetterQueue. Replay only returns an error if the message cannot be decoded or enqueued
+func (signal *AsyncSignal) Replay(ctx context.Context, message *EventMessage) error {
+	event, err := signal.Decode(ctx, message)
+	if err != nil {
+		return err
+	}
+	if err = signal.DefaultSignal.Dispatch(event); err == nil {
+		return nil
+	}
+	failed := *message
+	failed.Error = err.Error()
+	if failed.Attempts >= signal.GetMaxRetries() {
+		if signal.DeadLetterQueue == nil {
+			return nil
+		}
+		return signal.DeadLetterQueue.Enqueue(ctx, &failed)
+	}
+	failed.Delay = signal.GetRetryDelay() << uint(failed.Attempts)
+	failed.Attempts++
+	return signal.Queue.Enqueue(ctx, &failed)
+}
+
+// ServeHTTP replays the messages posted by a TaskQueue,
+// requests that do not come from a push queue are forbidden
+func (signal *AsyncSignal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-AppEngine-QueueName") == "" {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	var ctx context.Context
+	if signal.ContextFactory != nil {
+		ctx = signal.ContextFactory.Create(r)
+	} else {
+		ctx = appengine.NewContext(r)
+	}
+	message := &EventMessage{}
+	if err := json.NewDecoder(r.Body).Decode(message); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// messages that cannot be decoded are not retried
+	if _, err := signal.Decode(ctx, message); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := signal.Replay(ctx, message); err != nil {
+		// the push queue retries the message
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func typeName(t reflect.Type) string {
+	return t.PkgPath() + "." + t.Name()
+}
@@ -0,0 +1,157 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/Mparaiso/appengine/datastore"
+	"github.com/Mparaiso/go-tiger/test"
+)
+
+type BackgroundContextFactory struct{}
+
+func (BackgroundContextFactory) Create(r *http.Request) context.Context {
+	return context.Background()
+}
+
+// failingQueue is a Queue that cannot enqueue messages
+type failingQueue struct{}
+
+func (failingQueue) Enqueue(ctx context.Context, message *datastore.EventMessage) error {
+	return fmt.Errorf("queue unavailable")
+}
+
+// Given an AsyncSignal
+// When a Before* event is dispatched
+// It should be handled synchronously
+// When an After* event is dispatched
+// It should be enqueued then replayed to the listeners
+// When an event of an unregistered entity type is dispatched
+// It should fail before the write and be logged after the write
+// When an After* event cannot be enqueued
+// It should be logged without failing the write
+func TestAsyncSignal(t *testing.T) {
+	queue := datastore.NewInMemoryQueue()
+	signal := datastore.NewAsyncSignal(queue, &Article{})
+	events := []datastore.Event{}
+	signal.Add(datastore.ListenerFunc(func(e datastore.Event) error {
+		events = append(events, e)
+		return nil
+	}))
+	ctx := context.Background()
+	test.Fatal(t, signal.Dispatch(datastore.BeforeEntityCreatedEvent{Context: ctx, Entity: &Article{Title: "Title"}}), nil)
+	test.Fatal(t, len(events), 1, "Before* events should be dispatched synchronously")
+
+	test.Fatal(t, signal.Dispatch(datastore.AfterEntityUpdatedEvent{Context: ctx, Old: &Article{ID: 1, Title: "Old"}, New: &Article{ID: 1, Title: "New"}}), nil)
+	test.Fatal(t, len(events), 1, "After* events should not be dispatched synchronously")
+	test.Fatal(t, queue.Len(), 1)
+	test.Fatal(t, queue.Drain(ctx, signal), nil)
+	test.Fatal(t, len(events), 2)
+	event, ok := events[1].(datastore.AfterEntityUpdatedEvent)
+	test.Fatal(t, ok, true)
+	test.Error(t, event.Old.(*Article).Title, "Old")
+	test.Error(t, event.New.(*Article).Title, "New")
+	test.Error(t, event.Context, ctx)
+
+	logs := []string{}
+	defer func(logf func(context.Context, string, ...interface{})) { datastore.Logf = logf }(datastore.Logf)
+	datastore.Logf = func(ctx context.Context, format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	test.Error(t, signal.Dispatch(datastore.BeforeEntityCreatedEvent{Context: ctx, Entity: &Tag{Name: "go"}}), datastore.ErrUnregisteredEntity)
+	test.Error(t, len(events), 2, "listeners should not be called for unregistered entity types")
+	test.Error(t, signal.Dispatch(datastore.AfterEntityCreatedEvent{Context: ctx, Entity: &Tag{Name: "go"}}), nil)
+	test.Error(t, len(logs), 1, "the dropped event should be logged")
+	test.Error(t, queue.Len(), 0)
+
+	signal.Queue = failingQueue{}
+	test.Error(t, signal.Dispatch(datastore.AfterEntityCreatedEvent{Context: ctx, Entity: &Article{Title: "Title"}}), nil, "the write should not fail")
+	test.Error(t, len(logs), 2, "the event that cannot be enqueued should be logged")
+}
+
+// Given an AsyncSignal with a failing listener
+// When an event is replayed
+// It should be retried MaxRetries times with a growing delay then moved to the dead letter queue
+func TestAsyncSignal_Retry(t *testing.T) {
+	queue, deadLetters := datastore.NewInMemoryQueue(), datastore.NewInMemoryQueue()
+	signal := datastore.NewAsyncSignal(queue, &Article{})
+	signal.DeadLetterQueue = deadLetters
+	signal.MaxRetries = 2
+	signal.RetryDelay = time.Second
+	calls := 0
+	signal.Add(datastore.ListenerFunc(func(e datastore.Event) error {
+		if _, ok := e.(datastore.AfterEntityDeletedEvent); ok {
+			calls++
+			return fmt.Errorf("listener failed")
+		}
+		return nil
+	}))
+	ctx := context.Background()
+	test.Fatal(t, signal.Dispatch(datastore.AfterEntityDeletedEvent{Context: ctx, Entity: &Article{ID: 1}}), nil)
+	test.Fatal(t, queue.Drain(ctx, signal), nil)
+	test.Error(t, calls, 3)
+	test.Fatal(t, deadLetters.Len(), 1)
+	test.Error(t, deadLetters.Messages()[0].Attempts, 2)
+	test.Error(t, deadLetters.Messages()[0].Error, "listener failed")
+	test.Error(t, deadLetters.Messages()[0].Delay, 2*time.Second, "the delay should double on each retry")
+}
+
+// Given an AsyncSignal mounted as a push queue handler
+// When a message is posted
+// It should be replayed to the listeners
+func TestAsyncSignal_ServeHTTP(t *testing.T) {
+	signal := datastore.NewAsyncSignal(datastore.NewInMemoryQueue(), &Article{})
+	signal.ContextFactory = BackgroundContextFactory{}
+	titles := []string{}
+	signal.Add(datastore.ListenerFunc(func(e datastore.Event) error {
+		if event, ok := e.(datastore.AfterEntityCreatedEvent); ok {
+			titles = append(titles, event.Entity.(*Article).Title)
+		}
+		return nil
+	}))
+	payload, err := json.Marshal(datastore.EventMessage{
+		Event:  "AfterEntityCreatedEvent",
+		Type:   "github.com/Mparaiso/appengine/datastore_test.Article",
+		Entity: json.RawMessage(`{"Title":"Title"}`),
+	})
+	test.Fatal(t, err, nil)
+
+	response := httptest.NewRecorder()
+	signal.ServeHTTP(response, httptest.NewRequest("POST", "/_ah/events", bytes.NewReader(payload)))
+	test.Error(t, response.Code, http.StatusForbidden, "requests not coming from a push queue should be forbidden")
+
+	request := httptest.NewRequest("POST", "/_ah/events", bytes.NewReader(payload))
+	request.Header.Set("X-AppEngine-QueueName", "default")
+	response = httptest.NewRecorder()
+	signal.ServeHTTP(response, request)
+	test.Fatal(t, response.Code, http.StatusOK)
+	test.Fatal(t, len(titles), 1)
+	test.Error(t, titles[0], "Title")
+
+	request = httptest.NewRequest("POST", "/_ah/events", bytes.NewBufferString(`{"Event":"Unknown"}`))
+	request.Header.Set("X-AppEngine-QueueName", "default")
+	response = httptest.NewRecorder()
+	signal.ServeHTTP(response, request)
+	test.Error(t, response.Code, http.StatusBadRequest)
+}
@@ -0,0 +1,586 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Cache stores values by key. Implementations must be comparable, such as pointers,
+// so that adding the CacheInvalidator of a cache twice to a signal is a no-op
+type Cache interface {
+	// GetMulti returns the values of the keys found in the cache
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+	// SetMulti stores values expiring after ttl, they do not expire if ttl is 0
+	SetMulti(ctx context.Context, values map[string][]byte, ttl time.Duration) error
+	// AddMulti stores the values of the keys missing from the cache, the other values are ignored
+	AddMulti(ctx context.Context, values map[string][]byte, ttl time.Duration) error
+	// CompareAndSwapMulti stores the values of the keys whose cached value is still their value in old,
+	// the other values are ignored
+	CompareAndSwapMulti(ctx context.Context, old, values map[string][]byte, ttl time.Duration) error
+	// DeleteMulti removes keys, missing keys are ignored
+	DeleteMulti(ctx context.Context, keys []string) error
+}
+
+// MemcacheCache is a Cache storing values in App Engine memcache
+type MemcacheCache struct{}
+
+// GetMulti returns the values of the keys found in memcache
+func (MemcacheCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(items))
+	for key, item := range items {
+		values[key] = item.Value
+	}
+	return values, nil
+}
+
+// SetMulti stores values in memcache
+func (MemcacheCache) SetMulti(ctx context.Context, values map[string][]byte, ttl time.Duration) error {
+	items := make([]*memcache.Item, 0, len(values))
+	for key, value := range values {
+		items = append(items, &memcache.Item{Key: key, Value: value, Expiration: ttl})
+	}
+	return memcache.SetMulti(ctx, items)
+}
+
+// AddMulti stores the values of the keys missing from memcache
+func (MemcacheCache) AddMulti(ctx context.Context, values map[string][]byte, ttl time.Duration) error {
+	items := make([]*memcache.Item, 0, len(values))
+	for key, value := range values {
+		items = append(items, &memcache.Item{Key: key, Value: value, Expiration: ttl})
+	}
+	return ignoreMisses(memcache.AddMulti(ctx, items), memcache.ErrNotStored)
+}
+
+// CompareAndSwapMulti stores the values of the keys whose value in memcache is still their value in old
+func (MemcacheCache) CompareAndSwapMulti(ctx context.Context, old, values map[string][]byte, ttl time.Duration) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	cached, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+	items := []*memcache.Item{}
+	for key, item := range cached {
+		if bytes.Equal(item.Value, old[key]) {
+			item.Value, item.Expiration = values[key], ttl
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	return ignoreMisses(memcache.CompareAndSwapMulti(ctx, items), memcache.ErrCASConflict, memcache.ErrNotStored)
+}
+
+// DeleteMulti removes keys from memcache
+func (MemcacheCache) DeleteMulti(ctx context.Context, keys []string) error {
+	return ignoreMisses(memcache.DeleteMulti(ctx, keys), memcache.ErrCacheMiss)
+}
+
+// ignoreMisses returns nil if err is an appengine.MultiError of the ignored errors
+func ignoreMisses(err error, ignored ...error) error {
+	errs, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil && !containsError(ignored, err) {
+			return errs
+		}
+	}
+	return nil
+}
+
+func containsError(errs []error, err error) bool {
+	for _, e := range errs {
+		if e == err {
+			return true
+		}
+	}
+	return false
+}
+
+// lruEntry is a value of an LRUCache
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// LRUCache is an in-process Cache evicting the least recently used values,
+// it stands in for MemcacheCache outside App Engine, such as in tests
+type LRUCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  *list.List
+	elements map[string]*list.Element
+}
+
+// NewLRUCache creates an LRUCache holding at most capacity values, 0 means no limit
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{capacity: capacity, entries: list.New(), elements: map[string]*list.Element{}}
+}
+
+// GetMulti returns the values of the keys found in the cache that have not expired
+func (cache *LRUCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	values := map[string][]byte{}
+	for _, key := range keys {
+		if value, ok := cache.get(key); ok {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// get returns the value of key if it has not expired
+func (cache *LRUCache) get(key string) ([]byte, bool) {
+	element, ok := cache.elements[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		cache.entries.Remove(element)
+		delete(cache.elements, key)
+		return nil, false
+	}
+	cache.entries.MoveToFront(element)
+	return entry.value, true
+}
+
+// SetMulti stores values, the least recently used values are evicted beyond the capacity
+func (cache *LRUCache) SetMulti(ctx context.Context, values map[string][]byte, ttl time.Duration) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for key, value := range values {
+		cache.set(key, value, ttl)
+	}
+	return nil
+}
+
+// AddMulti stores the values of the keys missing from the cache
+func (cache *LRUCache) AddMulti(ctx context.Context, values map[string][]byte, ttl time.Duration) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for key, value := range values {
+		if _, ok := cache.get(key); !ok {
+			cache.set(key, value, ttl)
+		}
+	}
+	return nil
+}
+
+// CompareAndSwapMulti stores the values of the keys whose cached value is still their value in old
+func (cache *LRUCache) CompareAndSwapMulti(ctx context.Context, old, values map[string][]byte, ttl time.Duration) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for key, value := range values {
+		if current, ok := cache.get(key); ok && bytes.Equal(current, old[key]) {
+			cache.set(key, value, ttl)
+		}
+	}
+	return nil
+}
+
+// set stores value, the least recently used values are evicted beyond the capacity
+func (cache *LRUCache) set(key string, value []byte, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	if element, ok := cache.elements[key]; ok {
+		cache.entries.Remove(element)
+	}
+	cache.elements[key] = cache.entries.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for cache.capacity > 0 && cache.entries.Len() > cache.capacity {
+		oldest := cache.entries.Back()
+		cache.entries.Remove(oldest)
+		delete(cache.elements, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// DeleteMulti removes keys from the cache
+func (cache *LRUCache) DeleteMulti(ctx context.Context, keys []string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, key := range keys {
+		if element, ok := cache.elements[key]; ok {
+			cache.entries.Remove(element)
+			delete(cache.elements, key)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of values in the cache, including expired values
+func (cache *LRUCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.entries.Len()
+}
+
+// CacheKey returns the key of the entity stored at key in a Cache
+func CacheKey(key *datastore.Key) string {
+	return "datastore:" + key.Encode()
+}
+
+// CacheInvalidator is a Listener removing the entities of After* events from a Cache,
+// with the leases of the lookups reading them. It must listen to the signals of every
+// repository writing cached entities. Failures are logged with Logf since the entity is written.
+type CacheInvalidator struct {
+	Cache Cache
+}
+
+// Handle removes the entity of an After* event from the cache
+func (invalidator CacheInvalidator) Handle(e Event) error {
+	var (
+		ctx context.Context
+		key *datastore.Key
+	)
+	switch event := e.(type) {
+	case AfterEntityCreatedEvent:
+		ctx, key = event.Context, event.Key
+	case AfterEntityUpdatedEvent:
+		ctx, key = event.Context, event.Key
+	case AfterEntityDeletedEvent:
+		ctx, key = event.Context, event.Key
+	case AfterEntityRestoredEvent:
+		ctx, key = event.Context, event.Key
+	}
+	if key == nil {
+		return nil
+	}
+	if err := invalidator.Cache.DeleteMulti(ctx, []string{CacheKey(key)}); err != nil {
+		Logf(ctx, "Entity %s cannot be removed from the cache : %s", key, err)
+	}
+	return nil
+}
+
+// CachedRepository is a read-through cache of the lookups by ID and name of a Repository,
+// which must be a Keyer such as DefaultRepository. Other methods are those of the wrapped repository.
+// Soft deleted entities are not cached. Reads fall back to the wrapped repository when the cache fails.
+//
+// Entities are cached under a lease taken before they are read from the wrapped repository,
+// the CacheInvalidator removes the lease so that an entity read before a write is not cached after it.
+//
+//	repository := datastore.NewCachedRepository(ctx, datastore.NewDefaultRepository(ctx, "article"), nil)
+//	repository.TTL = 10 * time.Minute
+//	repository.NegativeTTL = time.Minute
+type CachedRepository struct {
+	Repository
+	Context context.Context
+	Cache   Cache
+	// TTL is the expiration of the cached entities of the kind of the repository, 0 means no expiration.
+	// NewCachedRepository sets it to DefaultCacheTTL
+	TTL time.Duration
+	// NegativeTTL is the expiration of the cached ErrNoSuchEntity errors,
+	// missing entities are not cached if it is 0
+	NegativeTTL time.Duration
+}
+
+// DefaultCacheTTL is the expiration of the entities cached by a CachedRepository created by NewCachedRepository,
+// so that an entity written without invalidating the cache is eventually read again
+const DefaultCacheTTL = time.Hour
+
+// cacheLease is the expiration of the leases of the entities read from the wrapped repository
+const cacheLease = 10 * time.Second
+
+// prefixes of the cached values
+const (
+	cachedEntity  byte = 'e'
+	cachedMissing byte = 'm'
+	cachedLease   byte = 'l'
+)
+
+// NewCachedRepository creates a CachedRepository wrapping repository, cache defaults to a MemcacheCache.
+// The CacheInvalidator of cache is added to the signal of repository if it is a SignalProvider.
+func NewCachedRepository(ctx context.Context, repository Repository, cache Cache) *CachedRepository {
+	if cache == nil {
+		cache = MemcacheCache{}
+	}
+	if provider, ok := repository.(SignalProvider); ok && provider.GetSignal() != nil {
+		provider.GetSignal().Add(CacheInvalidator{Cache: cache})
+	}
+	return &CachedRepository{Repository: repository, Context: ctx, Cache: cache, TTL: DefaultCacheTTL}
+}
+
+// SetParentKey sets the parent key of the wrapped repository if it is a ParentKeySetter
+func (repository CachedRepository) SetParentKey(key *datastore.Key) {
+	if setter, ok := repository.Repository.(ParentKeySetter); ok {
+		setter.SetParentKey(key)
+	}
+}
+
+// GetParentKey returns the parent key of the wrapped repository, or nil if it is not a ParentKeySetter
+func (repository CachedRepository) GetParentKey() *datastore.Key {
+	if setter, ok := repository.Repository.(ParentKeySetter); ok {
+		return setter.GetParentKey()
+	}
+	return nil
+}
+
+// Include returns a copy of the repository wrapping a copy of the wrapped repository including fields,
+// see Includer. Fields are ignored if the wrapped repository is not an Includer.
+func (repository CachedRepository) Include(fields ...string) Repository {
+	if includer, ok := repository.Repository.(Includer); ok {
+		repository.Repository = includer.Include(fields...)
+	}
+	return &repository
+}
+
+// Key returns the datastore key of an entity, see Keyer
+func (repository CachedRepository) Key(entity Entity) *datastore.Key {
+	if keyer, ok := repository.Repository.(Keyer); ok {
+		return keyer.Key(entity)
+	}
+	return nil
+}
+
+// GetSignal returns the signal of the wrapped repository, or nil if it is not a SignalProvider
+func (repository CachedRepository) GetSignal() Signal {
+	if provider, ok := repository.Repository.(SignalProvider); ok {
+		return provider.GetSignal()
+	}
+	return nil
+}
+
+// FindByID gets an entity by id from the cache or the wrapped repository
+func (repository CachedRepository) FindByID(id int64, entity Entity) error {
+	keyer, ok := repository.Repository.(Keyer)
+	if !ok {
+		return repository.Repository.FindByID(id, entity)
+	}
+	entity.SetID(id)
+	errs, err := repository.findMulti([]*datastore.Key{keyer.Key(entity)}, []Entity{entity}, func(missing []int) error {
+		return repository.Repository.FindByID(id, entity)
+	})
+	if err != nil {
+		return err
+	}
+	return errs[0]
+}
+
+// FindByName gets a NamedEntity by name from the cache or the wrapped repository
+func (repository CachedRepository) FindByName(name string, entity Entity) error {
+	keyer, ok := repository.Repository.(Keyer)
+	named, isNamed := entity.(NamedEntity)
+	if !ok || !isNamed {
+		return repository.Repository.FindByName(name, entity)
+	}
+	named.SetName(name)
+	errs, err := repository.findMulti([]*datastore.Key{keyer.Key(entity)}, []Entity{entity}, func(missing []int) error {
+		return repository.Repository.FindByName(name, entity)
+	})
+	if err != nil {
+		return err
+	}
+	named.SetName(name)
+	return errs[0]
+}
+
+// FindByIDs gets entities by ids into entities, a pointer to a slice resized to len(ids).
+// Entities missing from the cache are fetched from the wrapped repository in a single batch,
+// missing entities are reported in an appengine.MultiError indexed like ids.
+func (repository CachedRepository) FindByIDs(ids []int64, entities interface{}) error {
+	keyer, ok := repository.Repository.(Keyer)
+	slice := reflect.ValueOf(entities)
+	if !ok || slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return repository.Repository.FindByIDs(ids, entities)
+	}
+	slice = slice.Elem()
+	slice.Set(reflect.MakeSlice(slice.Type(), len(ids), len(ids)))
+	elemType := slice.Type().Elem()
+	values := make([]Entity, len(ids))
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		value := slice.Index(i)
+		if elemType.Kind() == reflect.Ptr {
+			value.Set(reflect.New(elemType.Elem()))
+		} else {
+			value = value.Addr()
+		}
+		entity, ok := value.Interface().(Entity)
+		if !ok {
+			return ErrNotAnEntity
+		}
+		entity.SetID(id)
+		values[i], keys[i] = entity, keyer.Key(entity)
+	}
+	errs, err := repository.findMulti(keys, values, func(missing []int) error {
+		missingIDs := make([]int64, len(missing))
+		for j, i := range missing {
+			missingIDs[j] = ids[i]
+		}
+		found := reflect.New(slice.Type())
+		err := repository.Repository.FindByIDs(missingIDs, found.Interface())
+		if _, ok := err.(appengine.MultiError); err != nil && !ok {
+			return err
+		}
+		for j, i := range missing {
+			slice.Index(i).Set(found.Elem().Index(j))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if hasErrors(errs) {
+		return errs
+	}
+	return nil
+}
+
+// findMulti loads entities from the cache, the others are loaded by find. find receives the indexes
+// of the missing entities and reports their errors in an appengine.MultiError indexed like missing.
+// Errors are returned indexed like keys, or as err if find fails as a whole.
+func (repository CachedRepository) findMulti(keys []*datastore.Key, entities []Entity, find func(missing []int) error) (errs appengine.MultiError, err error) {
+	cacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		cacheKeys[i] = CacheKey(key)
+	}
+	// the cache is best effort, failing to read or fill it does not fail the lookup
+	cached, err := repository.Cache.GetMulti(repository.Context, cacheKeys)
+	if err != nil {
+		cached = nil
+	}
+	errs = make(appengine.MultiError, len(keys))
+	missing := []int{}
+	for i := range keys {
+		value := cached[cacheKeys[i]]
+		switch {
+		case len(value) == 0:
+			missing = append(missing, i)
+		case value[0] == cachedMissing:
+			errs[i] = ErrNoSuchEntity
+		case value[0] != cachedEntity || LoadProperties(value[1:], entities[i]) != nil:
+			// leases of other lookups and values that cannot be loaded
+			missing = append(missing, i)
+		}
+	}
+	if hits := cacheHits(entities, errs, missing); len(hits) > 0 {
+		if includer, ok := repository.Repository.(includer); ok {
+			if err = includer.include(&hits); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return errs, nil
+	}
+	leases := repository.lease(cacheKeys, missing)
+	err = find(missing)
+	findErrs, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		if len(missing) != 1 {
+			return nil, err
+		}
+		findErrs = appengine.MultiError{err}
+	}
+	found, notFound, unfilled := map[string][]byte{}, map[string][]byte{}, []string{}
+	for j, i := range missing {
+		if findErrs != nil && findErrs[j] != nil {
+			errs[i] = findErrs[j]
+		}
+		switch {
+		case errs[i] == ErrNoSuchEntity && repository.NegativeTTL > 0:
+			notFound[cacheKeys[i]] = []byte{cachedMissing}
+		case errs[i] != nil, isDeleted(entities[i]):
+			unfilled = append(unfilled, cacheKeys[i])
+		default:
+			value, err := EncodeProperties(entities[i])
+			if err != nil {
+				Logf(repository.Context, "Entity %s cannot be cached : %s", keys[i], err)
+				unfilled = append(unfilled, cacheKeys[i])
+				continue
+			}
+			found[cacheKeys[i]] = append([]byte{cachedEntity}, value...)
+		}
+	}
+	// values are only cached if their lease has not been removed by an invalidation
+	if len(found) > 0 {
+		repository.Cache.CompareAndSwapMulti(repository.Context, leases, found, repository.TTL)
+	}
+	if len(notFound) > 0 {
+		repository.Cache.CompareAndSwapMulti(repository.Context, leases, notFound, repository.NegativeTTL)
+	}
+	if len(unfilled) > 0 {
+		repository.Cache.DeleteMulti(repository.Context, unfilled)
+	}
+	return errs, nil
+}
+
+// lease adds a lease to the cache for the keys at the missing indexes, and returns the leases by key
+func (repository CachedRepository) lease(cacheKeys []string, missing []int) map[string][]byte {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return nil
+	}
+	leases := make(map[string][]byte, len(missing))
+	for _, i := range missing {
+		leases[cacheKeys[i]] = append([]byte{cachedLease}, token...)
+	}
+	repository.Cache.AddMulti(repository.Context, leases, cacheLease)
+	return leases
+}
+
+// isDeleted returns true if entity is a soft deleted SoftDeletableEntity
+func isDeleted(entity Entity) bool {
+	deletable, ok := entity.(SoftDeletableEntity)
+	return ok && !deletable.GetDeleted().IsZero()
+}
+
+// cacheHits returns the entities found in the cache
+func cacheHits(entities []Entity, errs appengine.MultiError, missing []int) []Entity {
+	result := []Entity{}
+	for i, entity := range entities {
+		if errs[i] == nil && (len(missing) == 0 || !containsIndex(missing, i)) {
+			result = append(result, entity)
+		}
+	}
+	return result
+}
+
+func containsIndex(indexes []int, index int) bool {
+	for _, i := range indexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// includer is a repository loading the references of the entities it finds
+type includer interface {
+	include(result interface{}) error
+}
@@ -0,0 +1,180 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+
+	"github.com/Mparaiso/appengine/datastore"
+	"github.com/Mparaiso/go-tiger/test"
+)
+
+// Given a CachedRepository wrapping an InMemoryRepository
+// When entities are found
+// It should read them from the cache until they are updated or deleted
+func TestCachedRepository(t *testing.T) {
+	ctx := context.Background()
+	repository := datastore.NewInMemoryRepository(ctx, "book")
+	// writes through other repositories do not invalidate the cache
+	other := datastore.NewInMemoryRepository(ctx, "book")
+	other.Store = repository.Store
+	cache := datastore.NewLRUCache(0)
+	cached := datastore.NewCachedRepository(ctx, repository, cache)
+	cached.NegativeTTL = time.Minute
+
+	book := &Book{Title: "Dune"}
+	test.Fatal(t, cached.Create(book), nil)
+	found := &Book{}
+	test.Fatal(t, cached.FindByID(book.ID, found), nil)
+	test.Fatal(t, found.Title, "Dune")
+	test.Fatal(t, cache.Len(), 1)
+
+	test.Fatal(t, other.Update(&Book{ID: book.ID, Title: "Stale"}), nil)
+	found = &Book{}
+	test.Fatal(t, cached.FindByID(book.ID, found), nil)
+	test.Error(t, found.Title, "Dune", "the cached entity should be returned")
+
+	test.Fatal(t, cached.Update(&Book{ID: book.ID, Title: "Dune Messiah"}), nil)
+	test.Fatal(t, cache.Len(), 0, "an update should invalidate the cached entity")
+	found = &Book{}
+	test.Fatal(t, cached.FindByID(book.ID, found), nil)
+	test.Error(t, found.Title, "Dune Messiah")
+
+	test.Fatal(t, cached.Delete(found), nil)
+	test.Error(t, cached.FindByID(book.ID, &Book{}), datastore.ErrNoSuchEntity)
+	test.Fatal(t, cache.Len(), 1, "a missing entity should be cached")
+
+	test.Fatal(t, other.Create(&Book{ID: book.ID, Title: "Children of Dune"}), nil)
+	test.Error(t, cached.FindByID(book.ID, &Book{}), datastore.ErrNoSuchEntity, "the missing entity should be cached")
+}
+
+// racingRepository updates the entities it finds once, as if they were written
+// while the CachedRepository reads them
+type racingRepository struct {
+	*datastore.InMemoryRepository
+	raced bool
+}
+
+func (repository *racingRepository) FindByID(id int64, entity datastore.Entity) error {
+	if err := repository.InMemoryRepository.FindByID(id, entity); err != nil || repository.raced {
+		return err
+	}
+	repository.raced = true
+	return repository.InMemoryRepository.Update(&Book{ID: id, Title: "Written"})
+}
+
+// Given a CachedRepository
+// When an entity is written while it is read from the wrapped repository
+// It should not be cached
+func TestCachedRepository_Lease(t *testing.T) {
+	ctx := context.Background()
+	repository := &racingRepository{InMemoryRepository: datastore.NewInMemoryRepository(ctx, "book")}
+	cached := datastore.NewCachedRepository(ctx, repository, datastore.NewLRUCache(0))
+	test.Error(t, cached.TTL, datastore.DefaultCacheTTL)
+	book := &Book{Title: "Read"}
+	test.Fatal(t, cached.Create(book), nil)
+	found := &Book{}
+	test.Fatal(t, cached.FindByID(book.ID, found), nil)
+	test.Error(t, found.Title, "Read")
+	found = &Book{}
+	test.Fatal(t, cached.FindByID(book.ID, found), nil)
+	test.Error(t, found.Title, "Written", "the entity read before the write should not be cached")
+}
+
+// Given a CachedRepository
+// When entities are found by ids
+// It should only fetch the entities missing from the cache and report missing ids
+func TestCachedRepository_FindByIDs(t *testing.T) {
+	ctx := context.Background()
+	repository := datastore.NewInMemoryRepository(ctx, "book")
+	other := datastore.NewInMemoryRepository(ctx, "book")
+	other.Store = repository.Store
+	cache := datastore.NewLRUCache(0)
+	cached := datastore.NewCachedRepository(ctx, repository, cache)
+
+	books := []*Book{{Title: "Dune"}, {Title: "Hyperion"}}
+	test.Fatal(t, cached.CreateMulti(books[0], books[1]), nil)
+	test.Fatal(t, cached.FindByID(books[0].ID, &Book{}), nil)
+	test.Fatal(t, other.Update(&Book{ID: books[0].ID, Title: "Stale"}), nil)
+
+	found := []*Book{}
+	err := cached.FindByIDs([]int64{books[0].ID, 1000, books[1].ID}, &found)
+	errs, ok := err.(appengine.MultiError)
+	test.Fatal(t, ok, true)
+	test.Error(t, errs[0], nil)
+	test.Error(t, errs[1], datastore.ErrNoSuchEntity)
+	test.Error(t, errs[2], nil)
+	test.Fatal(t, len(found), 3)
+	test.Error(t, found[0].Title, "Dune", "the cached entity should be returned")
+	test.Error(t, found[2].Title, "Hyperion")
+	test.Error(t, cache.Len(), 2, "missing entities should not be cached without a NegativeTTL")
+}
+
+// Given a CachedRepository
+// When a parent key is set and fields are included
+// It should forward them to the wrapped repository
+func TestCachedRepository_Forwarding(t *testing.T) {
+	ctx := context.Background()
+	books := datastore.NewInMemoryRepository(ctx, "book")
+	book := &Book{Title: "Dune"}
+	test.Fatal(t, books.Create(book), nil)
+	reviews := datastore.NewInMemoryRepository(ctx, "review")
+	reviews.Store = books.Store
+	cached := datastore.NewCachedRepository(ctx, reviews, datastore.NewLRUCache(0))
+
+	cached.SetParentKey(books.Key(book))
+	test.Error(t, reviews.GetParentKey(), books.Key(book))
+	test.Error(t, cached.GetParentKey(), books.Key(book))
+	review := &Review{Body: "Great", Book: datastore.NewRef[*Book](books.Key(book))}
+	test.Fatal(t, cached.Create(review), nil)
+	test.Error(t, cached.Key(review).Parent(), books.Key(book))
+
+	including := cached.Include("Book")
+	for i := 0; i < 2; i++ {
+		found := &Review{}
+		test.Fatal(t, including.FindByID(review.ID, found), nil)
+		test.Fatal(t, found.Book.Entity != nil, true, "the referenced entity should be loaded")
+		test.Error(t, found.Book.Entity.Title, "Dune")
+	}
+}
+
+// Given an LRUCache
+// When values are stored beyond its capacity or expire
+// It should evict the least recently used or expired values
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	cache := datastore.NewLRUCache(2)
+	test.Fatal(t, cache.SetMulti(ctx, map[string][]byte{"a": []byte("a")}, 0), nil)
+	test.Fatal(t, cache.SetMulti(ctx, map[string][]byte{"b": []byte("b")}, 0), nil)
+	values, err := cache.GetMulti(ctx, []string{"a"})
+	test.Fatal(t, err, nil)
+	test.Fatal(t, string(values["a"]), "a")
+	test.Fatal(t, cache.SetMulti(ctx, map[string][]byte{"c": []byte("c")}, 0), nil)
+	values, _ = cache.GetMulti(ctx, []string{"a", "b", "c"})
+	test.Error(t, len(values), 2)
+	_, ok := values["b"]
+	test.Error(t, ok, false, "the least recently used value should be evicted")
+
+	test.Fatal(t, cache.SetMulti(ctx, map[string][]byte{"d": []byte("d")}, time.Nanosecond), nil)
+	time.Sleep(time.Millisecond)
+	values, _ = cache.GetMulti(ctx, []string{"d"})
+	test.Error(t, len(values), 0, "an expired value should not be returned")
+	test.Fatal(t, cache.DeleteMulti(ctx, []string{"a", "missing"}), nil)
+	test.Error(t, cache.Len(), 1)
+}
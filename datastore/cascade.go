@@ -0,0 +1,338 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// CascadeAction is applied by a CascadeRule to the entities referencing a deleted entity
+type CascadeAction string
+
+const (
+	// CascadeDelete removes the referencing entities
+	CascadeDelete CascadeAction = "delete"
+	// CascadeNullify removes the key of the deleted entity from the Field of the referencing entities
+	CascadeNullify CascadeAction = "nullify"
+	// CascadeRestrict prevents the deletion while referencing entities exist
+	CascadeRestrict CascadeAction = "restrict"
+)
+
+// CascadeRule is applied to the entities of Kind referencing a deleted entity.
+// Entities reference the deleted entity if Field holds its key,
+// or if they descend from it when Field is empty :
+//
+//	err := repository.SetCascade(
+//		datastore.CascadeRule{Kind: "comment", Action: datastore.CascadeDelete, New: func() datastore.Entity { return &Comment{} }},
+//		datastore.CascadeRule{Kind: "article", Field: "Author", Action: datastore.CascadeNullify, New: func() datastore.Entity { return &Article{} }},
+//		datastore.CascadeRule{Kind: "order", Field: "Customer", Action: datastore.CascadeRestrict},
+//	)
+//
+// Deleted and nullified entities are loaded with New and written like a repository
+// of their kind would, with events dispatched to the signal of the deleting repository,
+// so a LockedEntity is neither deleted nor nullified.
+//
+// Rules run in the cross-group transaction of the deletion, which spans at most
+// 25 entity groups including the one of the deleted entity. The datastore only runs
+// ancestor queries in transactions, so the entities referencing the deleted entity by
+// Field are queried outside of it : an entity referencing it that is written concurrently
+// is not seen by the rules, and a restrict rule does not prevent its deletion.
+type CascadeRule struct {
+	Kind   string
+	Field  string
+	Action CascadeAction
+	// New creates the entities of Kind, it is required by delete and nullify rules
+	New func() Entity
+}
+
+var (
+	// ErrDeleteRestricted is wrapped by ErrReferenced,
+	// errors.Is(err, ErrDeleteRestricted) is true for any restricted deletion
+	ErrDeleteRestricted   = fmt.Errorf("Entity is referenced and cannot be deleted")
+	ErrInvalidCascadeRule = fmt.Errorf("Invalid cascade rule")
+)
+
+// ErrReferenced is returned when an entity is deleted while
+// entities referencing it are restricted by a CascadeRule
+type ErrReferenced struct {
+	Kind  string
+	Field string
+}
+
+func (err *ErrReferenced) Error() string {
+	if err.Field == "" {
+		return fmt.Sprintf("Entity has %s children and cannot be deleted", err.Kind)
+	}
+	return fmt.Sprintf("Entity is referenced by %s.%s and cannot be deleted", err.Kind, err.Field)
+}
+
+// Unwrap returns ErrDeleteRestricted
+func (err *ErrReferenced) Unwrap() error {
+	return ErrDeleteRestricted
+}
+
+// validateCascade returns an error wrapping ErrInvalidCascadeRule if a rule is invalid
+func validateCascade(rules []CascadeRule) error {
+	for _, rule := range rules {
+		switch {
+		case rule.Kind == "":
+			return fmt.Errorf("%w : a rule must have a Kind", ErrInvalidCascadeRule)
+		case rule.Action != CascadeDelete && rule.Action != CascadeNullify && rule.Action != CascadeRestrict:
+			return fmt.Errorf("%w : unknown action %q", ErrInvalidCascadeRule, rule.Action)
+		case rule.Action == CascadeNullify && rule.Field == "":
+			return fmt.Errorf("%w : a nullify rule must have a Field", ErrInvalidCascadeRule)
+		case rule.Action != CascadeRestrict && rule.New == nil:
+			return fmt.Errorf("%w : a %s rule on %s must have a New function", ErrInvalidCascadeRule, rule.Action, rule.Kind)
+		}
+	}
+	return nil
+}
+
+// cascadeStore applies cascade rules to the storage of a repository
+type cascadeStore interface {
+	// referencing returns the keys of the entities referencing key according to rule
+	referencing(rule CascadeRule, key *datastore.Key) ([]*datastore.Key, error)
+	getMulti(keys []*datastore.Key, entities []Entity) error
+	putMulti(keys []*datastore.Key, entities []Entity) error
+	deleteMulti(keys []*datastore.Key) error
+	// dispatch dispatches a Before* event, dispatchAfter an After* event
+	// once the deletion is committed
+	dispatch(event Event) error
+	dispatchAfter(event Event) error
+	getContext() context.Context
+}
+
+// cascade applies rules to the entities referencing the deleted entity of key.
+// Only restrict rules are applied to an entity that is not removed, such as a soft deleted entity,
+// so that restoring it does not leave references to it dangling.
+func cascade(store cascadeStore, rules []CascadeRule, key *datastore.Key, removed bool) error {
+	for _, rule := range rules {
+		if rule.Action != CascadeRestrict && !removed {
+			continue
+		}
+		keys, err := store.referencing(rule, key)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		switch rule.Action {
+		case CascadeRestrict:
+			return &ErrReferenced{Kind: rule.Kind, Field: rule.Field}
+		case CascadeDelete:
+			err = cascadeDelete(store, rule, keys)
+		case CascadeNullify:
+			err = cascadeNullify(store, rule, keys, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cascadeDelete removes the entities of keys, even soft deletable ones
+func cascadeDelete(store cascadeStore, rule CascadeRule, keys []*datastore.Key) error {
+	entities := newEntities(rule, len(keys))
+	if err := store.getMulti(keys, entities); err != nil {
+		return err
+	}
+	for i, entity := range entities {
+		if err := store.dispatch(BeforeEntityDeletedEvent{Context: store.getContext(), Key: keys[i], Entity: entity}); err != nil {
+			return err
+		}
+	}
+	if err := store.deleteMulti(keys); err != nil {
+		return err
+	}
+	for i, entity := range entities {
+		if err := store.dispatchAfter(AfterEntityDeletedEvent{Context: store.getContext(), Key: keys[i], Entity: entity}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cascadeNullify removes key from the Field of the entities of keys
+func cascadeNullify(store cascadeStore, rule CascadeRule, keys []*datastore.Key, key *datastore.Key) error {
+	olds, news := newEntities(rule, len(keys)), newEntities(rule, len(keys))
+	if err := store.getMulti(keys, olds); err != nil {
+		return err
+	}
+	for i, old := range olds {
+		properties, err := save(old)
+		if err != nil {
+			return err
+		}
+		if err = load(news[i], nullifyProperties(properties, rule.Field, key)); err != nil {
+			return err
+		}
+		if err = store.dispatch(BeforeEntityUpdatedEvent{Context: store.getContext(), Key: keys[i], Old: old, New: news[i]}); err != nil {
+			return err
+		}
+	}
+	if err := store.putMulti(keys, news); err != nil {
+		return err
+	}
+	for i, entity := range news {
+		if err := store.dispatchAfter(AfterEntityUpdatedEvent{Context: store.getContext(), Key: keys[i], Old: olds[i], New: entity}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newEntities returns n entities created by the New function of rule
+func newEntities(rule CascadeRule, n int) []Entity {
+	entities := make([]Entity, n)
+	for i := range entities {
+		entities[i] = rule.New()
+	}
+	return entities
+}
+
+// withoutKey returns keys without key
+func withoutKey(keys []*datastore.Key, key *datastore.Key) []*datastore.Key {
+	result := []*datastore.Key{}
+	for _, k := range keys {
+		if !k.Equal(key) {
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+// nullifyProperties returns a copy of properties where the values of field equal to key
+// are nil, or removed for a multi-valued property
+func nullifyProperties(properties []datastore.Property, field string, key *datastore.Key) []datastore.Property {
+	result := []datastore.Property{}
+	for _, property := range properties {
+		if value, ok := property.Value.(*datastore.Key); ok && property.Name == field && value.Equal(key) {
+			if property.Multiple {
+				continue
+			}
+			property.Value = nil
+		}
+		result = append(result, property)
+	}
+	return result
+}
+
+// defaultCascadeStore applies cascade rules in the datastore
+type defaultCascadeStore struct {
+	repository DefaultRepository
+}
+
+// referencing looks children up in the transaction of the repository,
+// the other references are queried outside of it since the datastore
+// only runs ancestor queries in transactions
+func (store defaultCascadeStore) referencing(rule CascadeRule, key *datastore.Key) ([]*datastore.Key, error) {
+	query := datastore.NewQuery(rule.Kind).KeysOnly()
+	ctx := store.repository.Context
+	if rule.Field == "" {
+		query = query.Ancestor(key)
+	} else {
+		query = query.Filter(rule.Field+" =", key)
+		if store.repository.outside != nil {
+			ctx = store.repository.outside
+		}
+	}
+	keys, err := query.GetAll(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return withoutKey(keys, key), nil
+}
+
+func (store defaultCascadeStore) getMulti(keys []*datastore.Key, entities []Entity) error {
+	return datastore.GetMulti(store.repository.Context, keys, entities)
+}
+
+func (store defaultCascadeStore) putMulti(keys []*datastore.Key, entities []Entity) error {
+	_, err := datastore.PutMulti(store.repository.Context, keys, entities)
+	return err
+}
+
+func (store defaultCascadeStore) deleteMulti(keys []*datastore.Key) error {
+	return datastore.DeleteMulti(store.repository.Context, keys)
+}
+
+func (store defaultCascadeStore) dispatch(event Event) error {
+	return store.repository.Dispatch(event)
+}
+
+func (store defaultCascadeStore) dispatchAfter(event Event) error {
+	return store.repository.dispatchAfter(event)
+}
+
+func (store defaultCascadeStore) getContext() context.Context {
+	return store.repository.Context
+}
+
+// memoryCascadeStore applies cascade rules in the MemoryStore of a repository
+type memoryCascadeStore struct {
+	repository InMemoryRepository
+}
+
+func (store memoryCascadeStore) referencing(rule CascadeRule, key *datastore.Key) ([]*datastore.Key, error) {
+	keys := []*datastore.Key{}
+	if rule.Field == "" {
+		for _, entity := range store.repository.Store.all(rule.Kind, key) {
+			keys = append(keys, entity.key)
+		}
+		return withoutKey(keys, key), nil
+	}
+	filters := []Filter{{Field: rule.Field, Operator: Eq, Value: key}}
+	for _, entity := range store.repository.Store.all(rule.Kind, nil) {
+		if matches(entity.properties, filters, nil) {
+			keys = append(keys, entity.key)
+		}
+	}
+	return keys, nil
+}
+
+func (store memoryCascadeStore) getMulti(keys []*datastore.Key, entities []Entity) error {
+	for i, key := range keys {
+		if err := store.repository.Store.get(key, entities[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store memoryCascadeStore) putMulti(keys []*datastore.Key, entities []Entity) error {
+	return store.repository.Store.putMulti(keys, entities)
+}
+
+func (store memoryCascadeStore) deleteMulti(keys []*datastore.Key) error {
+	store.repository.Store.deleteMulti(keys)
+	return nil
+}
+
+func (store memoryCascadeStore) dispatch(event Event) error {
+	return store.repository.Dispatch(event)
+}
+
+func (store memoryCascadeStore) dispatchAfter(event Event) error {
+	return store.repository.dispatchAfter(event)
+}
+
+func (store memoryCascadeStore) getContext() context.Context {
+	return store.repository.Context
+}
@@ -0,0 +1,485 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Mparaiso/appengine/datastore"
+	"github.com/Mparaiso/go-tiger/test"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	appengine_datastore "google.golang.org/appengine/datastore"
+)
+
+// RepositoryFactory creates the repositories checked by the conformance suite,
+// repositories created by a factory share the same entities
+type RepositoryFactory func(kind string, parent *appengine_datastore.Key, listeners ...datastore.Listener) datastore.Repository
+
+type Book struct {
+	ID    int64
+	Title string
+	Year  int
+	Tags  []string
+}
+
+// GetID returns a int64
+func (book Book) GetID() int64 {
+	return book.ID
+}
+
+// SetID sets *Book.ID
+func (book *Book) SetID(ID int64) {
+	book.ID = ID
+}
+
+func titles(books []*Book) string {
+	result := []string{}
+	for _, book := range books {
+		result = append(result, book.Title)
+	}
+	return strings.Join(result, ",")
+}
+
+func TestInMemoryRepository(t *testing.T) {
+	ctx := context.Background()
+	store := datastore.NewMemoryStore()
+	SubTestRepositoryConformance(t, ctx, func(kind string, parent *appengine_datastore.Key, listeners ...datastore.Listener) datastore.Repository {
+		repository := datastore.NewInMemoryRepository(ctx, kind, listeners...)
+		repository.Store = store
+		repository.SetParentKey(parent)
+		return repository
+	})
+}
+
+func TestDefaultRepository_Conformance(t *testing.T) {
+	instance, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	test.Fatal(t, err, nil)
+	defer instance.Close()
+	request, err := instance.NewRequest("GET", "/", nil)
+	test.Fatal(t, err, nil)
+	ctx := appengine.NewContext(request)
+	SubTestRepositoryConformance(t, ctx, func(kind string, parent *appengine_datastore.Key, listeners ...datastore.Listener) datastore.Repository {
+		repository := datastore.NewDefaultRepository(ctx, kind, listeners...)
+		repository.SetParentKey(parent)
+		return repository
+	})
+}
+
+// SubTestRepositoryConformance checks that a Repository implementation
+// behaves like DefaultRepository
+func SubTestRepositoryConformance(t *testing.T, ctx context.Context, factory RepositoryFactory) {
+	SubTestRepositoryCRUD(t, factory)
+	SubTestRepositoryQueries(t, factory)
+	SubTestRepositorySoftDelete(t, factory)
+	SubTestRepositoryBatchOperations(t, factory)
+	SubTestRepositoryParentKey(t, ctx, factory)
+	SubTestRepositoryTransactions(t, factory)
+	SubTestRepositoryCascade(t, factory)
+	SubTestRepositoryInclude(t, factory)
+}
+
+// Given a repository
+// When an entity is created, updated and deleted
+// It should be found until it is deleted
+// It should check the versions of versioned entities
+// It should key named entities by name and not overwrite them on creation
+func SubTestRepositoryCRUD(t *testing.T, factory RepositoryFactory) {
+	repository := factory("crud_articles", nil)
+	article := &Article{Title: "Title"}
+	test.Fatal(t, repository.Create(article), nil)
+	test.Fatal(t, article.ID != 0, true, "an ID should be allocated")
+	test.Error(t, article.Version, int64(1))
+	found := &Article{}
+	test.Fatal(t, repository.FindByID(article.ID, found), nil)
+	test.Error(t, found.Title, "Title")
+
+	found.Title = "New title"
+	test.Fatal(t, repository.Update(found), nil)
+	test.Error(t, found.Version, int64(2))
+	err := repository.Update(&Article{ID: article.ID, Title: "Stale title", Version: 1})
+	test.Error(t, errors.Is(err, datastore.ErrVersionMismatch), true)
+	test.Error(t, repository.Update(&Article{ID: article.ID + 1000}), datastore.ErrNoSuchEntity)
+
+	test.Fatal(t, repository.Delete(found), nil)
+	test.Error(t, repository.FindByID(article.ID, &Article{}), datastore.ErrNoSuchEntity)
+
+	tags := factory("crud_tags", nil)
+	test.Error(t, tags.Create(&Tag{}), datastore.ErrEmptyName)
+	test.Fatal(t, tags.Create(&Tag{Name: "golang"}), nil)
+	tag := &Tag{}
+	test.Fatal(t, tags.FindByName("golang", tag), nil)
+	test.Error(t, tag.Name, "golang")
+	test.Error(t, tags.FindByName("rust", &Tag{}), datastore.ErrNoSuchEntity)
+	test.Error(t, tags.Create(&Tag{Name: "golang"}), datastore.ErrEntityExists)
+	test.Error(t, tags.CreateMulti(&Tag{Name: "rust"}, &Tag{Name: "golang"}), datastore.ErrEntityExists)
+	test.Error(t, tags.FindByName("rust", &Tag{}), datastore.ErrNoSuchEntity, "nothing should be written when a name is taken")
+}
+
+// Given entities
+// When they are queried
+// Filters, orders, limits, offsets, projections and cursors should be applied
+func SubTestRepositoryQueries(t *testing.T, factory RepositoryFactory) {
+	repository := factory("query_books", nil)
+	test.Fatal(t, repository.CreateMulti(
+		&Book{Title: "A", Year: 1990, Tags: []string{"classic"}},
+		&Book{Title: "B", Year: 2001, Tags: []string{"scifi", "classic"}},
+		&Book{Title: "C", Year: 2005, Tags: []string{"scifi"}},
+		&Book{Title: "D", Year: 2010, Tags: []string{"fantasy"}},
+		&Book{Title: "E", Year: 1995, Tags: []string{"fantasy", "scifi"}},
+	), nil)
+	for _, fixture := range []struct {
+		Query    datastore.Query
+		Expected string
+	}{
+		{datastore.Where("Year", datastore.Gte, 2000).OrderBy("-Year"), "D,C,B"},
+		{datastore.Query{}.In("Title", "A", "C", "Z").OrderBy("Year"), "A,C"},
+		{datastore.Query{}.NotEqual("Year", 2001).OrderBy("Year"), "A,E,C,D"},
+		{datastore.Where("Tags", datastore.Eq, "scifi").OrderBy("Year"), "E,B,C"},
+		{datastore.Query{Query: map[string]interface{}{"Year <": 2000}, Order: []string{"-Year"}}, "E,A"},
+		{datastore.Query{Order: []string{"Year"}, Limit: 2, Offset: 1}, "E,B"},
+		{datastore.Query{}.In("Tags", "fantasy", "classic").OrderBy("Title"), "A,B,D,E"},
+	} {
+		books := []*Book{}
+		test.Fatal(t, repository.FindBy(fixture.Query, &books), nil)
+		test.Error(t, titles(books), fixture.Expected, fixture.Query)
+	}
+
+	count, err := repository.Count(datastore.Where("Year", datastore.Gte, 2000))
+	test.Fatal(t, err, nil)
+	test.Error(t, count, 3)
+
+	keys := []*appengine_datastore.Key{}
+	test.Fatal(t, repository.FindBy(datastore.Where("Year", datastore.Lt, 2000).KeysOnly(), &keys), nil)
+	test.Error(t, len(keys), 2)
+
+	books := []*Book{}
+	test.Fatal(t, repository.FindBy(datastore.Query{}.Project("Title").OrderBy("Title").Where("Title", datastore.Lte, "B"), &books), nil)
+	test.Fatal(t, titles(books), "A,B")
+	test.Error(t, books[0].Year, 0, "only projected fields should be loaded")
+
+	pages, cursor := []string{}, ""
+	for i := 0; i < 5; i++ {
+		page := []*Book{}
+		cursor, err = repository.FindPage(datastore.Query{Order: []string{"Year"}, Limit: 2}, cursor, &page)
+		test.Fatal(t, err, nil)
+		pages = append(pages, titles(page))
+		if cursor == "" {
+			break
+		}
+	}
+	test.Error(t, strings.Join(pages, "|"), "A,E|B,C|D")
+	_, err = repository.FindPage(datastore.Query{Limit: 2}, "not a cursor", &[]*Book{})
+	test.Error(t, err, datastore.ErrInvalidCursor)
+	pages, cursor = []string{}, ""
+	for i := 0; i < 5; i++ {
+		page := []*Book{}
+		cursor, err = repository.FindPage(datastore.Query{Order: []string{"Title"}, Limit: 2}.In("Title", "A", "B", "C"), cursor, &page)
+		test.Fatal(t, err, nil)
+		pages = append(pages, titles(page))
+		if cursor == "" {
+			break
+		}
+	}
+	test.Error(t, strings.Join(pages, "|"), "A,B|C", "every page of a query using In should be reachable")
+	_, err = repository.FindPage(datastore.Query{Limit: 2}.In("Title", "A", "B"), "not a cursor", &[]*Book{})
+	test.Error(t, err, datastore.ErrInvalidCursor)
+}
+
+// Given a soft deletable entity
+// When it is deleted
+// It should only be found when it is restored
+// When it is purged
+// It should not be restored
+// When soft deletable entities without a Deleted property are queried
+// It should return ErrNoDeletedProperty
+func SubTestRepositorySoftDelete(t *testing.T, factory RepositoryFactory) {
+	repository := factory("soft_delete_comments", nil)
+	comment, other := &Comment{Body: "Body"}, &Comment{Body: "Other"}
+	test.Fatal(t, repository.CreateMulti(comment, other), nil)
+	test.Fatal(t, repository.Delete(&Comment{ID: comment.ID}), nil)
+	test.Error(t, repository.FindByID(comment.ID, &Comment{}), datastore.ErrNoSuchEntity)
+	comments := []*Comment{}
+	test.Fatal(t, repository.FindAll(&comments), nil)
+	test.Fatal(t, len(comments), 1)
+	test.Error(t, comments[0].Body, "Other")
+	count, err := repository.Count(datastore.Query{})
+	test.Fatal(t, err, nil)
+	test.Error(t, count, 2, "the kind should not be known as soft deletable without New or SoftDelete")
+	repository.(datastore.EntityFactorySetter).SetNew(func() datastore.Entity { return &Comment{} })
+	count, err = repository.Count(datastore.Query{})
+	test.Fatal(t, err, nil)
+	test.Error(t, count, 1, "soft deleted entities should not be counted")
+
+	test.Fatal(t, repository.Restore(&Comment{ID: comment.ID}), nil)
+	count, err = repository.Count(datastore.Query{})
+	test.Fatal(t, err, nil)
+	test.Error(t, count, 2)
+	restored := &Comment{}
+	test.Fatal(t, repository.FindByID(comment.ID, restored), nil)
+	test.Error(t, restored.Body, "Body")
+
+	test.Fatal(t, repository.Purge(restored), nil)
+	test.Error(t, repository.Restore(&Comment{ID: comment.ID}), datastore.ErrNoSuchEntity)
+	test.Error(t, repository.Restore(&Tag{Name: "golang"}), datastore.ErrNotSoftDeletable)
+
+	replies := factory("soft_delete_replies", nil)
+	test.Fatal(t, replies.Create(&Reply{}), nil)
+	test.Error(t, replies.FindAll(&[]*Reply{}), datastore.ErrNoDeletedProperty)
+	_, err = replies.FindPage(datastore.Query{Limit: 1}, "", &[]Reply{})
+	test.Error(t, err, datastore.ErrNoDeletedProperty)
+}
+
+// Given multiple entities
+// When they are fetched and deleted in batch
+// Errors should be reported in an appengine.MultiError indexed like the entities
+// When a listener fails
+// Nothing should be deleted
+func SubTestRepositoryBatchOperations(t *testing.T, factory RepositoryFactory) {
+	repository := factory("batch_documents", nil)
+	first, second, locked := &Document{Body: "First"}, &Document{Body: "Second"}, &Document{Body: "Locked", Locked: true}
+	test.Fatal(t, repository.CreateMulti(first, second, locked), nil)
+
+	documents := []*Document{}
+	err := repository.FindByIDs([]int64{first.ID, locked.ID + 1000, second.ID}, &documents)
+	errs, ok := err.(appengine.MultiError)
+	test.Fatal(t, ok, true, "error should be an appengine.MultiError")
+	test.Error(t, errs[0], nil)
+	test.Error(t, errs[1], datastore.ErrNoSuchEntity)
+	test.Error(t, errs[2], nil)
+	test.Error(t, documents[2].Body, "Second")
+
+	err = repository.DeleteMulti(&Document{ID: first.ID}, &Document{ID: locked.ID})
+	errs, ok = err.(appengine.MultiError)
+	test.Fatal(t, ok, true, "error should be an appengine.MultiError")
+	test.Error(t, errs[0], nil)
+	test.Error(t, errs[1], datastore.ErrEntityLocked)
+	test.Error(t, repository.FindByID(first.ID, &Document{}), nil, "nothing should be deleted if a listener fails")
+
+	test.Fatal(t, repository.DeleteMulti(first, second), nil)
+	test.Error(t, repository.FindByIDs([]int64{first.ID, second.ID}, &documents) != nil, true)
+}
+
+// Given repositories with a parent key
+// When entities are created
+// Queries should be scoped to the parent key
+func SubTestRepositoryParentKey(t *testing.T, ctx context.Context, factory RepositoryFactory) {
+	first := factory("parent_chapters", appengine_datastore.NewKey(ctx, "parent_books", "", 1, nil))
+	second := factory("parent_chapters", appengine_datastore.NewKey(ctx, "parent_books", "", 2, nil))
+	test.Fatal(t, first.CreateMulti(&Book{Title: "A"}, &Book{Title: "B"}), nil)
+	test.Fatal(t, second.Create(&Book{Title: "C"}), nil)
+
+	books := []*Book{}
+	test.Fatal(t, first.FindBy(datastore.Query{Order: []string{"Title"}}, &books), nil)
+	test.Error(t, titles(books), "A,B")
+	books = []*Book{}
+	test.Fatal(t, factory("parent_chapters", nil).FindBy(datastore.Query{Order: []string{"Title"}}, &books), nil)
+	test.Error(t, titles(books), "A,B,C", "queries without an ancestor should not be scoped")
+	test.Error(t, second.FindByID(books[0].ID, &Book{}), datastore.ErrNoSuchEntity)
+}
+
+// Given a repository
+// When entities are created in a transaction
+// After* events should only be dispatched once the transaction is committed
+// When the transaction fails
+// Nothing should be written and no After* event should be dispatched
+// When a Before* listener fails
+// The entity should not be created
+// Events should carry the key of the entity
+func SubTestRepositoryTransactions(t *testing.T, factory RepositoryFactory) {
+	created := 0
+	keys := []*appengine_datastore.Key{}
+	repository := factory("transaction_articles", nil, datastore.ListenerFunc(func(e datastore.Event) error {
+		switch event := e.(type) {
+		case datastore.BeforeEntityCreatedEvent:
+			if event.Entity.(*Article).Title == "Forbidden" {
+				return fmt.Errorf("forbidden")
+			}
+		case datastore.AfterEntityCreatedEvent:
+			created++
+			keys = append(keys, event.Key)
+		}
+		return nil
+	}))
+	err := repository.RunInTransaction(func(tx datastore.Repository) error {
+		if err := tx.CreateMulti(&Article{Title: "First"}, &Article{Title: "Second"}); err != nil {
+			return err
+		}
+		test.Error(t, created, 0, "After* events should not be dispatched before commit")
+		return nil
+	}, &appengine_datastore.TransactionOptions{XG: true})
+	test.Fatal(t, err, nil)
+	test.Error(t, created, 2)
+	test.Fatal(t, len(keys), 2)
+	test.Error(t, keys[0].Kind(), "transaction_articles")
+	test.Error(t, keys[0].IntID() != 0, true)
+
+	third := &Article{Title: "Third"}
+	err = repository.RunInTransaction(func(tx datastore.Repository) error {
+		if err := tx.Create(third); err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	}, nil)
+	test.Fatal(t, err != nil, true)
+	test.Error(t, created, 2, "After* events should not be dispatched on rollback")
+	test.Error(t, repository.FindByID(third.ID, &Article{}), datastore.ErrNoSuchEntity)
+
+	test.Fatal(t, repository.Create(&Article{Title: "Forbidden"}) != nil, true)
+	count, err := repository.Count(datastore.Query{})
+	test.Fatal(t, err, nil)
+	test.Error(t, count, 2)
+}
+
+type Post struct {
+	ID     int64
+	Title  string
+	Author *appengine_datastore.Key
+}
+
+// GetID returns a int64
+func (post Post) GetID() int64 {
+	return post.ID
+}
+
+// SetID sets *Post.ID
+func (post *Post) SetID(ID int64) {
+	post.ID = ID
+}
+
+// Given a repository of authors with cascade rules
+// When an author is deleted
+// Its children should be deleted and references to it should be nullified
+// When an author referenced by a restricted kind is deleted
+// It should return ErrDeleteRestricted and nothing should be written
+func SubTestRepositoryCascade(t *testing.T, factory RepositoryFactory) {
+	authors := factory("cascade_authors", nil)
+	setter := authors.(datastore.CascadeSetter)
+	err := setter.SetCascade(datastore.CascadeRule{Kind: "cascade_posts", Field: "Author", Action: datastore.CascadeNullify})
+	test.Error(t, errors.Is(err, datastore.ErrInvalidCascadeRule), true, "a nullify rule without New should be invalid")
+	err = setter.SetCascade(datastore.CascadeRule{Kind: "cascade_posts", Action: datastore.CascadeNullify, New: func() datastore.Entity { return &Post{} }})
+	test.Error(t, errors.Is(err, datastore.ErrInvalidCascadeRule), true, "a nullify rule without Field should be invalid")
+	test.Fatal(t, setter.SetCascade(
+		datastore.CascadeRule{Kind: "cascade_notes", Action: datastore.CascadeDelete, New: func() datastore.Entity { return &Document{} }},
+		datastore.CascadeRule{Kind: "cascade_posts", Field: "Author", Action: datastore.CascadeNullify, New: func() datastore.Entity { return &Post{} }},
+		datastore.CascadeRule{Kind: "cascade_orders", Field: "Author", Action: datastore.CascadeRestrict},
+	), nil)
+	events := []datastore.Event{}
+	authors.(datastore.SignalProvider).GetSignal().Add(datastore.ListenerFunc(func(e datastore.Event) error {
+		switch event := e.(type) {
+		case datastore.AfterEntityDeletedEvent:
+			if event.Key.Kind() == "cascade_notes" {
+				events = append(events, e)
+			}
+		case datastore.AfterEntityUpdatedEvent:
+			events = append(events, e)
+		}
+		return nil
+	}))
+	first, second := &Book{Title: "First"}, &Book{Title: "Second"}
+	test.Fatal(t, authors.CreateMulti(first, second), nil)
+	firstKey, secondKey := authors.(datastore.Keyer).Key(first), authors.(datastore.Keyer).Key(second)
+	posts := factory("cascade_posts", nil)
+	firstPost, secondPost := &Post{Title: "First", Author: firstKey}, &Post{Title: "Second", Author: secondKey}
+	test.Fatal(t, posts.CreateMulti(firstPost, secondPost), nil)
+	notes := factory("cascade_notes", firstKey)
+	test.Fatal(t, notes.CreateMulti(&Document{Body: "A"}, &Document{Body: "B"}), nil)
+	test.Fatal(t, factory("cascade_orders", nil).Create(&Post{Title: "Order", Author: secondKey}), nil)
+
+	test.Fatal(t, authors.Delete(first), nil)
+	count, err := notes.Count(datastore.Query{})
+	test.Fatal(t, err, nil)
+	test.Error(t, count, 0, "children should be deleted")
+	post := &Post{}
+	test.Fatal(t, posts.FindByID(firstPost.ID, post), nil)
+	test.Error(t, post.Author == nil, true, "references should be nullified")
+	test.Error(t, len(events), 3, "cascaded writes should dispatch events")
+
+	third := &Book{Title: "Third"}
+	test.Fatal(t, authors.Create(third), nil)
+	locked := factory("cascade_notes", authors.(datastore.Keyer).Key(third))
+	test.Fatal(t, locked.Create(&Document{Body: "Locked", Locked: true}), nil)
+	test.Error(t, authors.Delete(third), datastore.ErrEntityLocked)
+	count, err = locked.Count(datastore.Query{})
+	test.Fatal(t, err, nil)
+	test.Error(t, count, 1, "a locked child should not be deleted")
+
+	err = authors.Delete(second)
+	test.Error(t, errors.Is(err, datastore.ErrDeleteRestricted), true)
+	test.Error(t, authors.FindByID(second.ID, &Book{}), nil)
+	test.Fatal(t, posts.FindByID(secondPost.ID, post), nil)
+	test.Error(t, post.Author != nil && post.Author.Equal(secondKey), true, "nothing should be written when a rule restricts the deletion")
+}
+
+type Review struct {
+	ID      int64
+	Body    string
+	Book    datastore.Ref[*Book]
+	Related []datastore.Ref[*Book]
+}
+
+// GetID returns a int64
+func (review Review) GetID() int64 {
+	return review.ID
+}
+
+// SetID sets *Review.ID
+func (review *Review) SetID(ID int64) {
+	review.ID = ID
+}
+
+// Given reviews referencing books
+// When they are found by a repository including the references
+// The referenced books should be loaded, missing books should be left nil
+// When they are found by a repository that does not include them
+// The referenced books should not be loaded
+func SubTestRepositoryInclude(t *testing.T, factory RepositoryFactory) {
+	books := factory("include_books", nil)
+	first, second := &Book{Title: "First"}, &Book{Title: "Second"}
+	test.Fatal(t, books.CreateMulti(first, second), nil)
+	firstKey, secondKey := books.(datastore.Keyer).Key(first), books.(datastore.Keyer).Key(second)
+	missingKey := books.(datastore.Keyer).Key(&Book{ID: second.ID + 1000})
+	reviews := factory("include_reviews", nil)
+	review := &Review{Body: "Review", Book: datastore.NewRef[*Book](firstKey), Related: []datastore.Ref[*Book]{
+		datastore.NewRef[*Book](secondKey), datastore.NewRef[*Book](missingKey),
+	}}
+	test.Fatal(t, reviews.CreateMulti(review, &Review{Body: "Other", Book: datastore.NewRef[*Book](secondKey)}), nil)
+
+	found := &Review{}
+	including := reviews.(datastore.Includer).Include("book", "Related")
+	test.Fatal(t, including.FindByID(review.ID, found), nil)
+	test.Fatal(t, found.Book.Entity != nil, true, "the referenced book should be loaded")
+	test.Error(t, found.Book.Entity.Title, "First")
+	test.Fatal(t, len(found.Related), 2)
+	test.Error(t, found.Related[0].Entity.Title, "Second")
+	test.Error(t, found.Related[1].Entity == nil, true, "a missing book should be left nil")
+
+	list := []*Review{}
+	test.Fatal(t, including.FindBy(datastore.Query{Order: []string{"Body"}}, &list), nil)
+	test.Fatal(t, len(list), 2)
+	test.Error(t, list[0].Book.Entity.Title, "Second")
+	test.Error(t, list[1].Book.Entity.Title, "First")
+
+	found = &Review{}
+	test.Fatal(t, reviews.FindByID(review.ID, found), nil)
+	test.Error(t, found.Book.Key.Equal(firstKey), true)
+	test.Error(t, found.Book.Entity == nil, true)
+	err := reviews.(datastore.Includer).Include("Body").FindByID(review.ID, found)
+	test.Error(t, errors.Is(err, datastore.ErrNotAReference), true)
+}
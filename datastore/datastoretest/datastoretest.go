@@ -0,0 +1,30 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package datastoretest prepares the tests using InMemoryRepositories outside App Engine.
+//
+// Keys need an application ID, which App Engine provides. Importing the package
+// sets a default one with datastore.SetDefaultAppID :
+//
+//	import _ "github.com/Mparaiso/appengine/datastore/datastoretest"
+package datastoretest
+
+import "github.com/Mparaiso/appengine/datastore"
+
+// AppID is the application ID of the keys created outside App Engine
+const AppID = "in-memory"
+
+func init() {
+	datastore.SetDefaultAppID(AppID)
+}
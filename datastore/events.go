@@ -16,33 +16,71 @@ package datastore
 
 import (
 	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
 )
 
 type BeforeEntityDeletedEvent struct {
 	Context context.Context
+	Key     *datastore.Key
 	Entity
 }
 type AfterEntityDeletedEvent struct {
 	Context context.Context
+	Key     *datastore.Key
 	Entity
 }
 type BeforeEntityUpdatedEvent struct {
 	Context context.Context
+	Key     *datastore.Key
 	Old     Entity
 	New     Entity
 }
 type AfterEntityUpdatedEvent struct {
 	Context context.Context
+	Key     *datastore.Key
 	Old     Entity
 	New     Entity
 }
 
 type BeforeEntityCreatedEvent struct {
 	Context context.Context
+	Key     *datastore.Key
 	Entity
 }
 
 type AfterEntityCreatedEvent struct {
 	Context context.Context
+	Key     *datastore.Key
 	Entity
 }
+
+type BeforeEntityRestoredEvent struct {
+	Context context.Context
+	Key     *datastore.Key
+	Entity
+}
+
+type AfterEntityRestoredEvent struct {
+	Context context.Context
+	Key     *datastore.Key
+	Entity
+}
+
+// withContext returns a copy of an After* event bound to ctx
+func withContext(e Event, ctx context.Context) Event {
+	switch event := e.(type) {
+	case AfterEntityCreatedEvent:
+		event.Context = ctx
+		return event
+	case AfterEntityUpdatedEvent:
+		event.Context = ctx
+		return event
+	case AfterEntityDeletedEvent:
+		event.Context = ctx
+		return event
+	case AfterEntityRestoredEvent:
+		event.Context = ctx
+		return event
+	}
+	return e
+}
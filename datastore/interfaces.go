@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
 )
 
 // An Entity is a datastore entity
@@ -31,6 +32,14 @@ type Entity interface {
 	SetID(int64)
 }
 
+// NamedEntity is an entity keyed by a string name, such as a username
+// or a slug, rather than by an int64 ID
+type NamedEntity interface {
+	Entity
+	GetName() string
+	SetName(string)
+}
+
 // CreatedUpdatedSetter is capable to set created and updated timestamps on a struct
 type CreatedUpdatedEntity interface {
 	SetCreated(date time.Time)
@@ -41,6 +50,24 @@ type VersionedEntity interface {
 	GetVersion() int64
 }
 
+// SoftDeletableEntity is marked as deleted rather than removed
+// from the datastore, GetDeleted returns the zero time unless the entity is deleted.
+//
+// The deletion time must be saved in an indexed time.Time property named Deleted, see DeletedProperty,
+// queries of other soft deletable entities return ErrNoDeletedProperty. Queries filter out
+// soft deleted entities with an equality filter on Deleted, so sorted queries and queries
+// with inequality filters need composite indexes starting with Deleted, declared in index.yaml :
+//
+//	- kind: comment
+//	  properties:
+//	  - name: Deleted
+//	  - name: Created
+//	    direction: desc
+type SoftDeletableEntity interface {
+	SetDeleted(time.Time)
+	GetDeleted() time.Time
+}
+
 type LockedEntity interface {
 	IsLocked() bool
 }
@@ -50,6 +77,14 @@ type ContextFactory interface {
 	Create(r *http.Request) context.Context
 }
 
+// ContextFactoryFunc is a function implementing ContextFactory
+type ContextFactoryFunc func(r *http.Request) context.Context
+
+// Create calls f
+func (f ContextFactoryFunc) Create(r *http.Request) context.Context {
+	return f(r)
+}
+
 // ContextProvider provides a context
 type ContextProvider interface {
 	GetContext() context.Context
@@ -61,3 +96,34 @@ type RepositoryProvider interface {
 type SignalProvider interface {
 	GetSignal() Signal
 }
+
+// ParentKeySetter is a repository whose entities can be scoped to a parent entity
+type ParentKeySetter interface {
+	SetParentKey(key *datastore.Key)
+	GetParentKey() *datastore.Key
+}
+
+// EntityFactorySetter is a repository creating the entities it loads with a factory
+type EntityFactorySetter interface {
+	SetNew(New func() Entity)
+}
+
+// ExistenceChecker is a repository able to check that an entity of any kind exists
+type ExistenceChecker interface {
+	Exists(key *datastore.Key) (bool, error)
+}
+
+// CascadeSetter is a repository applying cascade rules to the entities referencing deleted entities
+type CascadeSetter interface {
+	SetCascade(rules ...CascadeRule) error
+}
+
+// Includer is a repository able to load the entities referenced by the Ref fields of the entities it finds
+type Includer interface {
+	Include(fields ...string) Repository
+}
+
+// Keyer is a repository able to return the datastore key of its entities
+type Keyer interface {
+	Key(entity Entity) *datastore.Key
+}
@@ -15,7 +15,6 @@
 package datastore
 
 import (
-	"fmt"
 	"time"
 )
 
@@ -38,12 +37,12 @@ func BeforeEntityUpdatedListener(e Event) error {
 	case BeforeEntityUpdatedEvent:
 		if entity, ok := event.Old.(LockedEntity); ok {
 			if entity.IsLocked() {
-				return fmt.Errorf("Entity is locked and cannot be modified")
+				return ErrEntityLocked
 			}
 		}
 		if entity, ok := event.Old.(VersionedEntity); ok {
 			if old, new := entity, event.New.(VersionedEntity); old.GetVersion() != new.GetVersion() {
-				return fmt.Errorf("Versions do not match old : %d , new : %d", old.GetVersion(), new.GetVersion())
+				return &ErrVersionConflict{Expected: old.GetVersion(), Actual: new.GetVersion()}
 			} else {
 				new.SetVersion(old.GetVersion() + 1)
 			}
@@ -61,7 +60,7 @@ func BeforeEntityDeletedListener(e Event) error {
 	case BeforeEntityDeletedEvent:
 		if entity, ok := event.Entity.(LockedEntity); ok {
 			if entity.IsLocked() {
-				return fmt.Errorf("Entity is locked and cannot be modified")
+				return ErrEntityLocked
 			}
 		}
 	}
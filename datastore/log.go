@@ -0,0 +1,27 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore
+
+import (
+	"github.com/Mparaiso/appengine/logger"
+	"golang.org/x/net/context"
+)
+
+// Logf logs the errors that do not fail an operation, such as the failures of a cache.
+// It writes warnings to the App Engine log service, which requires an App Engine context,
+// so it must be replaced outside of App Engine, such as in tests.
+var Logf = func(ctx context.Context, format string, args ...interface{}) {
+	logger.NewLogger(ctx).LogF(logger.Warning, format, args...)
+}
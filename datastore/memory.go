@@ -0,0 +1,931 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// memoryEntity is an entity stored in a MemoryStore
+type memoryEntity struct {
+	key        *datastore.Key
+	properties []datastore.Property
+}
+
+// MemoryStore holds the entities of InMemoryRepositories,
+// repositories sharing a store see each other's entities
+type MemoryStore struct {
+	mutex    sync.RWMutex
+	entities map[string]memoryEntity
+	lastID   int64
+	// transaction serializes transactions
+	transaction sync.Mutex
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+// Keys need an application ID, outside App Engine SetDefaultAppID must be called
+// before repositories using the store create keys, tests can import datastoretest to call it
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entities: map[string]memoryEntity{}}
+}
+
+// SetDefaultAppID sets the GAE_APPLICATION environment variable of the process to appID
+// if it is not set, so that keys can be created outside App Engine, such as in tests
+func SetDefaultAppID(appID string) {
+	if os.Getenv("GAE_APPLICATION") == "" {
+		os.Setenv("GAE_APPLICATION", appID)
+	}
+}
+
+// allocateIDs reserves n IDs and returns the first one
+func (store *MemoryStore) allocateIDs(n int) int64 {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	low := store.lastID + 1
+	store.lastID += int64(n)
+	return low
+}
+
+// get loads the entity stored at key into dst
+func (store *MemoryStore) get(key *datastore.Key, dst interface{}) error {
+	store.mutex.RLock()
+	stored, ok := store.entities[key.Encode()]
+	store.mutex.RUnlock()
+	if !ok {
+		return ErrNoSuchEntity
+	}
+	return load(dst, stored.properties)
+}
+
+// putMulti saves entities, nothing is stored if an entity cannot be saved
+func (store *MemoryStore) putMulti(keys []*datastore.Key, entities []Entity) error {
+	stored := make([]memoryEntity, len(keys))
+	for i, key := range keys {
+		properties, err := save(entities[i])
+		if err != nil {
+			return err
+		}
+		stored[i] = memoryEntity{key: key, properties: properties}
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, entity := range stored {
+		store.entities[entity.key.Encode()] = entity
+	}
+	return nil
+}
+
+func (store *MemoryStore) deleteMulti(keys []*datastore.Key) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, key := range keys {
+		delete(store.entities, key.Encode())
+	}
+}
+
+// all returns the entities of kind descending from ancestor, ordered by key
+func (store *MemoryStore) all(kind string, ancestor *datastore.Key) []memoryEntity {
+	store.mutex.RLock()
+	entities := []memoryEntity{}
+	for _, entity := range store.entities {
+		if entity.key.Kind() == kind && hasAncestor(entity.key, ancestor) {
+			entities = append(entities, entity)
+		}
+	}
+	store.mutex.RUnlock()
+	sort.Slice(entities, func(i, j int) bool { return compareKeys(entities[i].key, entities[j].key) < 0 })
+	return entities
+}
+
+// snapshot copies the entities so that a transaction can be rolled back
+func (store *MemoryStore) snapshot() map[string]memoryEntity {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	entities := make(map[string]memoryEntity, len(store.entities))
+	for encoded, entity := range store.entities {
+		entities[encoded] = entity
+	}
+	return entities
+}
+
+func (store *MemoryStore) restore(entities map[string]memoryEntity) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.entities = entities
+}
+
+// hasAncestor returns true if ancestor is nil, key or an ancestor of key
+func hasAncestor(key, ancestor *datastore.Key) bool {
+	if ancestor == nil {
+		return true
+	}
+	for ; key != nil; key = key.Parent() {
+		if key.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+func save(entity interface{}) ([]datastore.Property, error) {
+	if saver, ok := entity.(datastore.PropertyLoadSaver); ok {
+		return saver.Save()
+	}
+	return datastore.SaveStruct(entity)
+}
+
+func load(dst interface{}, properties []datastore.Property) error {
+	// loaders may modify the properties
+	properties = append([]datastore.Property{}, properties...)
+	if loader, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return loader.Load(properties)
+	}
+	return datastore.LoadStruct(dst, properties)
+}
+
+// memoryTransactionKey is the context key of the transaction of a MemoryStore
+type memoryTransactionKey struct{}
+
+// memoryTransaction is a running transaction, repositories created with
+// the context of the transaction join it
+type memoryTransaction struct {
+	store   *MemoryStore
+	pending *[]Event
+}
+
+// InMemoryRepository is a Repository storing entities in a MemoryStore,
+// it behaves like DefaultRepository without a datastore and is meant for tests.
+// Transactions are serialized and rolling back a transaction restores
+// the whole store, including writes made outside of the transaction.
+type InMemoryRepository struct {
+	Context   context.Context
+	Kind      string
+	Signal    Signal
+	ParentKey *datastore.Key
+	// IncludeDeleted makes queries and lookups return soft deleted entities
+	IncludeDeleted bool
+	// SoftDelete marks the kind as soft deletable, see DefaultRepository.SoftDelete
+	SoftDelete bool
+	// New creates the entities loaded to be compared with updated entities,
+	// they are created with reflection if not set
+	New func() Entity
+	// cascadeRules are applied to the entities referencing deleted entities, see SetCascade
+	cascadeRules []CascadeRule
+	// Includes lists the Ref fields whose entities are loaded by lookups and queries, see Include
+	Includes []string
+	// Store holds the entities, it must not be nil
+	Store *MemoryStore
+	// pending holds the After* events dispatched during a transaction
+	pending *[]Event
+}
+
+// NewInMemoryRepository creates an InMemoryRepository with a new MemoryStore
+func NewInMemoryRepository(ctx context.Context, kind string, listeners ...Listener) *InMemoryRepository {
+	repository := NewInMemoryRepositoryWithSignal(ctx, kind, NewDefaultSignal())
+	for _, listener := range listeners {
+		repository.Signal.Add(listener)
+	}
+	return repository
+}
+
+// NewInMemoryRepositoryWithSignal creates an InMemoryRepository with an external signal and a new MemoryStore
+func NewInMemoryRepositoryWithSignal(ctx context.Context, kind string, signal Signal) *InMemoryRepository {
+	repository := &InMemoryRepository{Context: ctx, Kind: kind, Signal: signal, Store: NewMemoryStore()}
+	addDefaultListeners(repository.Signal)
+	return repository
+}
+
+// SetParentKey sets the parent key
+func (repository *InMemoryRepository) SetParentKey(key *datastore.Key) {
+	repository.ParentKey = key
+}
+
+// GetParentKey returns the parent key or nil if not set
+func (repository InMemoryRepository) GetParentKey() *datastore.Key {
+	return repository.ParentKey
+}
+
+// SetNew sets the factory of the entities loaded by the repository
+func (repository *InMemoryRepository) SetNew(New func() Entity) {
+	repository.New = New
+}
+
+// SetCascade sets the rules applied to the entities referencing deleted entities, see DefaultRepository.SetCascade
+func (repository *InMemoryRepository) SetCascade(rules ...CascadeRule) error {
+	if err := validateCascade(rules); err != nil {
+		return err
+	}
+	repository.cascadeRules = rules
+	return nil
+}
+
+// Include returns a copy of the repository loading the entities referenced
+// by the Ref fields of the entities it finds, see DefaultRepository.Include
+func (repository InMemoryRepository) Include(fields ...string) Repository {
+	repository.Includes = fields
+	return &repository
+}
+
+// include loads the entities referenced by the Includes fields of result
+func (repository InMemoryRepository) include(result interface{}) error {
+	return include(repository.Includes, result, func(keys []*datastore.Key, dst []Entity) error {
+		errs := make(appengine.MultiError, len(keys))
+		for i, key := range keys {
+			errs[i] = repository.Store.get(key, dst[i])
+		}
+		if hasErrors(errs) {
+			return errs
+		}
+		return nil
+	})
+}
+
+// Exists returns true if an entity is stored at key, whatever its kind
+func (repository InMemoryRepository) Exists(key *datastore.Key) (bool, error) {
+	err := repository.Store.get(key, &datastore.PropertyList{})
+	if err == ErrNoSuchEntity {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Key returns the datastore key of an entity,
+// a NamedEntity is keyed by its name
+func (repository InMemoryRepository) Key(entity Entity) *datastore.Key {
+	if named, ok := entity.(NamedEntity); ok {
+		return datastore.NewKey(repository.Context, repository.Kind, named.GetName(), 0, repository.GetParentKey())
+	}
+	return datastore.NewKey(repository.Context, repository.Kind, "", entity.GetID(), repository.GetParentKey())
+}
+
+// GetSignal returns the signal of the repository
+func (repository InMemoryRepository) GetSignal() Signal {
+	return repository.Signal
+}
+
+// Dispatch dispatches an event to the Signal if the Signal is not null
+func (repository InMemoryRepository) Dispatch(event Event) error {
+	if repository.Signal != nil {
+		return repository.Signal.Dispatch(event)
+	}
+	return nil
+}
+
+// dispatchAfter dispatches an After* event, the event is deferred
+// until commit if the repository is bound to a transaction
+func (repository InMemoryRepository) dispatchAfter(event Event) error {
+	if repository.pending != nil {
+		*repository.pending = append(*repository.pending, event)
+		return nil
+	}
+	return repository.Dispatch(event)
+}
+
+// RunInTransaction runs f in a transaction, see DefaultRepository.RunInTransaction.
+// The store is restored if f returns an error, opts are ignored.
+// Repositories of the same store created with the context of tx join the transaction.
+func (repository InMemoryRepository) RunInTransaction(f func(tx Repository) error, opts *datastore.TransactionOptions) error {
+	return repository.runInTransaction(func(tx InMemoryRepository) error { return f(tx) })
+}
+
+func (repository InMemoryRepository) runInTransaction(f func(tx InMemoryRepository) error) error {
+	if repository.pending != nil {
+		return f(repository)
+	}
+	if transaction, ok := repository.Context.Value(memoryTransactionKey{}).(*memoryTransaction); ok && transaction.store == repository.Store {
+		repository.pending = transaction.pending
+		return f(repository)
+	}
+	pending := &[]Event{}
+	tx := repository
+	tx.Context = context.WithValue(repository.Context, memoryTransactionKey{}, &memoryTransaction{store: repository.Store, pending: pending})
+	tx.pending = pending
+	repository.Store.transaction.Lock()
+	snapshot := repository.Store.snapshot()
+	err := f(tx)
+	if err != nil {
+		repository.Store.restore(snapshot)
+	}
+	repository.Store.transaction.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, event := range *pending {
+		if err = repository.Dispatch(withContext(event, repository.Context)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create an entity, an ID is allocated unless the entity is a NamedEntity
+func (repository InMemoryRepository) Create(entity Entity) error {
+	return repository.CreateMulti(entity)
+}
+
+// CreateMulti persist multiple entities into the store,
+// ErrEntityExists is returned if an entity is stored with the name of a NamedEntity
+func (repository InMemoryRepository) CreateMulti(entities ...Entity) error {
+	for _, entity := range entities {
+		if _, ok := entity.(NamedEntity); ok {
+			return repository.runInTransaction(func(tx InMemoryRepository) error {
+				return tx.createMulti(entities)
+			})
+		}
+	}
+	return repository.createMulti(entities)
+}
+
+func (repository InMemoryRepository) createMulti(entities []Entity) error {
+	unnamed := 0
+	for _, entity := range entities {
+		if named, ok := entity.(NamedEntity); !ok {
+			unnamed++
+		} else if named.GetName() == "" {
+			return ErrEmptyName
+		} else if err := repository.Store.get(repository.Key(entity), &datastore.PropertyList{}); err == nil {
+			return ErrEntityExists
+		}
+	}
+	low := repository.Store.allocateIDs(unnamed)
+	keys := make([]*datastore.Key, len(entities))
+	for i, entity := range entities {
+		if _, ok := entity.(NamedEntity); !ok {
+			entity.SetID(low)
+			low++
+		}
+		keys[i] = repository.Key(entity)
+		if err := repository.Dispatch(BeforeEntityCreatedEvent{Context: repository.Context, Key: keys[i], Entity: entity}); err != nil {
+			return err
+		}
+	}
+	if err := repository.Store.putMulti(keys, entities); err != nil {
+		return err
+	}
+	for i, entity := range entities {
+		if err := repository.dispatchAfter(AfterEntityCreatedEvent{Context: repository.Context, Key: keys[i], Entity: entity}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update an entity, the version of a VersionedEntity is checked in a transaction
+func (repository InMemoryRepository) Update(entity Entity) error {
+	err := repository.UpdateMulti(entity)
+	if multi, ok := err.(appengine.MultiError); ok {
+		return multi[0]
+	}
+	return err
+}
+
+// UpdateMulti updates multiple entities. Errors are reported in an appengine.MultiError
+// indexed like entities, nothing is written if an entity is missing or a listener fails.
+func (repository InMemoryRepository) UpdateMulti(entities ...Entity) error {
+	versions := map[int]int64{}
+	for i, entity := range entities {
+		if versioned, ok := entity.(VersionedEntity); ok {
+			versions[i] = versioned.GetVersion()
+		}
+	}
+	if len(versions) == 0 {
+		return repository.updateMulti(entities)
+	}
+	err := repository.runInTransaction(func(tx InMemoryRepository) error {
+		return tx.updateMulti(entities)
+	})
+	if err != nil {
+		for i, version := range versions {
+			entities[i].(VersionedEntity).SetVersion(version)
+		}
+	}
+	return err
+}
+
+func (repository InMemoryRepository) updateMulti(entities []Entity) error {
+	keys := make([]*datastore.Key, len(entities))
+	olds := make([]Entity, len(entities))
+	for i, entity := range entities {
+		keys[i] = repository.Key(entity)
+		olds[i] = newEntity(repository.New, entity)
+	}
+	errs := repository.getMulti(keys, olds)
+	for i, entity := range entities {
+		if errs[i] == nil {
+			errs[i] = repository.Dispatch(BeforeEntityUpdatedEvent{Context: repository.Context, Key: keys[i], Old: olds[i], New: entity})
+		}
+	}
+	if hasErrors(errs) {
+		return errs
+	}
+	if err := repository.Store.putMulti(keys, entities); err != nil {
+		return err
+	}
+	for i, entity := range entities {
+		if err := repository.dispatchAfter(AfterEntityUpdatedEvent{Context: repository.Context, Key: keys[i], Old: olds[i], New: entity}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete an entity, a SoftDeletableEntity is marked as deleted
+// instead of being removed from the store
+func (repository InMemoryRepository) Delete(entity Entity) error {
+	err := repository.DeleteMulti(entity)
+	if multi, ok := err.(appengine.MultiError); ok {
+		return multi[0]
+	}
+	return err
+}
+
+// DeleteMulti deletes multiple entities. Errors are reported in an appengine.MultiError
+// indexed like entities, nothing is written if a listener fails.
+// Soft deletable and locked entities are loaded before listeners are called.
+func (repository InMemoryRepository) DeleteMulti(entities ...Entity) error {
+	if len(repository.cascadeRules) == 0 && !anyLoadsBeforeDelete(entities) {
+		return repository.deleteMulti(entities, false)
+	}
+	return repository.runInTransaction(func(tx InMemoryRepository) error {
+		return tx.deleteMulti(entities, false)
+	})
+}
+
+// deleteMulti deletes entities, soft deletable entities are
+// removed from the store if purge is true
+func (repository InMemoryRepository) deleteMulti(entities []Entity, purge bool) error {
+	var (
+		softKeys, hardKeys []*datastore.Key
+		softEntities       []Entity
+	)
+	errs := make(appengine.MultiError, len(entities))
+	keys := make([]*datastore.Key, len(entities))
+	removed := make([]bool, len(entities))
+	for i, entity := range entities {
+		key := repository.Key(entity)
+		keys[i] = key
+		_, soft := entity.(SoftDeletableEntity)
+		soft = soft && !purge
+		if soft {
+			errs[i] = repository.get(key, entity)
+			softKeys = append(softKeys, key)
+			softEntities = append(softEntities, entity)
+		} else {
+			if _, locked := entity.(LockedEntity); locked {
+				errs[i] = repository.Store.get(key, entity)
+			}
+			removed[i] = true
+			hardKeys = append(hardKeys, key)
+		}
+	}
+	for i, entity := range entities {
+		if errs[i] == nil {
+			errs[i] = repository.Dispatch(BeforeEntityDeletedEvent{Context: repository.Context, Key: keys[i], Entity: entity})
+		}
+	}
+	for i := range entities {
+		if errs[i] == nil && len(repository.cascadeRules) > 0 {
+			errs[i] = cascade(memoryCascadeStore{repository}, repository.cascadeRules, keys[i], removed[i])
+		}
+	}
+	if hasErrors(errs) {
+		return errs
+	}
+	if len(softKeys) > 0 {
+		now := time.Now()
+		for _, entity := range softEntities {
+			entity.(SoftDeletableEntity).SetDeleted(now)
+		}
+		if err := repository.Store.putMulti(softKeys, softEntities); err != nil {
+			return err
+		}
+	}
+	repository.Store.deleteMulti(hardKeys)
+	for i, entity := range entities {
+		if err := repository.dispatchAfter(AfterEntityDeletedEvent{Context: repository.Context, Key: keys[i], Entity: entity}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore restores a soft deleted entity
+func (repository InMemoryRepository) Restore(entity Entity) error {
+	deletable, ok := entity.(SoftDeletableEntity)
+	if !ok {
+		return ErrNotSoftDeletable
+	}
+	return repository.runInTransaction(func(tx InMemoryRepository) error {
+		key := tx.Key(entity)
+		if err := tx.Store.get(key, entity); err != nil {
+			return err
+		}
+		if err := tx.Dispatch(BeforeEntityRestoredEvent{Context: tx.Context, Key: key, Entity: entity}); err != nil {
+			return err
+		}
+		deletable.SetDeleted(time.Time{})
+		if err := tx.Store.putMulti([]*datastore.Key{key}, []Entity{entity}); err != nil {
+			return err
+		}
+		return tx.dispatchAfter(AfterEntityRestoredEvent{Context: tx.Context, Key: key, Entity: entity})
+	})
+}
+
+// Purge removes an entity from the store, even if it is soft deletable
+func (repository InMemoryRepository) Purge(entity Entity) error {
+	var err error
+	if _, ok := entity.(LockedEntity); ok || len(repository.cascadeRules) > 0 {
+		err = repository.runInTransaction(func(tx InMemoryRepository) error {
+			return tx.deleteMulti([]Entity{entity}, true)
+		})
+	} else {
+		err = repository.deleteMulti([]Entity{entity}, true)
+	}
+	if multi, ok := err.(appengine.MultiError); ok {
+		return multi[0]
+	}
+	return err
+}
+
+// get loads an entity, a soft deleted entity is not found
+// unless IncludeDeleted is set
+func (repository InMemoryRepository) get(key *datastore.Key, entity interface{}) error {
+	if err := repository.Store.get(key, entity); err != nil {
+		return err
+	}
+	if deletable, ok := entity.(SoftDeletableEntity); ok && !repository.IncludeDeleted && !deletable.GetDeleted().IsZero() {
+		return ErrNoSuchEntity
+	}
+	return nil
+}
+
+// getMulti loads multiple entities into dst, a slice, errors are indexed like keys
+func (repository InMemoryRepository) getMulti(keys []*datastore.Key, dst interface{}) appengine.MultiError {
+	errs := make(appengine.MultiError, len(keys))
+	values := reflect.ValueOf(dst)
+	for i, key := range keys {
+		value := values.Index(i)
+		if value.Kind() != reflect.Ptr && value.Kind() != reflect.Interface {
+			value = value.Addr()
+		}
+		errs[i] = repository.get(key, value.Interface())
+	}
+	return errs
+}
+
+// FindByID gets an entity by id
+func (repository InMemoryRepository) FindByID(id int64, entity Entity) error {
+	if err := repository.get(datastore.NewKey(repository.Context, repository.Kind, "", id, repository.GetParentKey()), entity); err != nil {
+		return err
+	}
+	return repository.include(entity)
+}
+
+// FindByIDs gets entities by ids into entities, a pointer to a slice resized to len(ids).
+// Missing entities are reported in an appengine.MultiError indexed like ids.
+func (repository InMemoryRepository) FindByIDs(ids []int64, entities interface{}) error {
+	slice := reflect.ValueOf(entities)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return ErrNotASlicePointer
+	}
+	slice = slice.Elem()
+	slice.Set(reflect.MakeSlice(slice.Type(), len(ids), len(ids)))
+	if elemType := slice.Type().Elem(); elemType.Kind() == reflect.Ptr {
+		for i := range ids {
+			slice.Index(i).Set(reflect.New(elemType.Elem()))
+		}
+	}
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = datastore.NewKey(repository.Context, repository.Kind, "", id, repository.GetParentKey())
+	}
+	if errs := repository.getMulti(keys, slice.Interface()); hasErrors(errs) {
+		return errs
+	}
+	return repository.include(entities)
+}
+
+// FindByName gets a NamedEntity by name
+func (repository InMemoryRepository) FindByName(name string, entity Entity) error {
+	key := datastore.NewKey(repository.Context, repository.Kind, name, 0, repository.GetParentKey())
+	if err := repository.get(key, entity); err != nil {
+		return err
+	}
+	if named, ok := entity.(NamedEntity); ok {
+		named.SetName(name)
+	}
+	return repository.include(entity)
+}
+
+// FindAll returns all entities
+func (repository InMemoryRepository) FindAll(entities interface{}) error {
+	return repository.FindBy(Query{}, entities)
+}
+
+// FindBy fetches the entities matching query into result, a pointer to a slice.
+// The keys of a keys-only query are fetched into result if it is a *[]*datastore.Key.
+func (repository InMemoryRepository) FindBy(query Query, result interface{}) error {
+	excludeDeleted, err := repository.excludesDeleted(result)
+	if err != nil {
+		return err
+	}
+	entities, _, err := repository.run(query, excludeDeleted)
+	if err != nil {
+		return err
+	}
+	entities = paginate(entities, query.Offset, query.Limit)
+	if query.keysOnly {
+		if dst, ok := result.(*[]*datastore.Key); ok {
+			*dst = make([]*datastore.Key, len(entities))
+			for i, entity := range entities {
+				(*dst)[i] = entity.key
+			}
+		}
+		return nil
+	}
+	if err = repository.appendAll(entities, query, result); err != nil {
+		return err
+	}
+	return repository.include(result)
+}
+
+// FindPage fetches at most query.Limit entities into result, a pointer to a slice,
+// starting at cursor, see DefaultRepository.FindPage. Cursors are positions in the results.
+func (repository InMemoryRepository) FindPage(query Query, cursor string, result interface{}) (string, error) {
+	slice := reflect.ValueOf(result)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return "", ErrNotASlicePointer
+	}
+	excludeDeleted, err := repository.excludesDeleted(result)
+	if err != nil {
+		return "", err
+	}
+	entities, queries, err := repository.run(query, excludeDeleted)
+	if err != nil {
+		return "", err
+	}
+	if queries == 0 {
+		return "", nil
+	}
+	start := 0
+	if cursor != "" {
+		if start, err = strconv.Atoi(cursor); err != nil || start < 0 {
+			return "", ErrInvalidCursor
+		}
+	}
+	if start > len(entities) {
+		start = len(entities)
+	}
+	page := paginate(entities[start:], query.Offset, query.Limit)
+	if err = repository.appendAll(page, query, result); err != nil {
+		return "", err
+	}
+	if err = repository.include(result); err != nil {
+		return "", err
+	}
+	if query.Limit <= 0 || len(page) < query.Limit {
+		return "", nil
+	}
+	return strconv.Itoa(start + query.Offset + len(page)), nil
+}
+
+// Count returns the object count given a query, soft deleted entities
+// are excluded like by DefaultRepository.Count
+func (repository InMemoryRepository) Count(query Query) (int, error) {
+	excludeDeleted, err := repository.countExcludesDeleted()
+	if err != nil {
+		return 0, err
+	}
+	entities, _, err := repository.run(query, excludeDeleted)
+	if err != nil {
+		return 0, err
+	}
+	return len(paginate(entities, query.Offset, query.Limit)), nil
+}
+
+// excludesDeleted returns true if soft deleted entities must be filtered out
+// of a query loading values into result
+func (repository InMemoryRepository) excludesDeleted(result interface{}) (bool, error) {
+	return excludesDeleted(result, repository.IncludeDeleted, repository.SoftDelete)
+}
+
+// countExcludesDeleted returns true if soft deleted entities must be filtered out of a count,
+// see DefaultRepository.countExcludesDeleted
+func (repository InMemoryRepository) countExcludesDeleted() (bool, error) {
+	return countExcludesDeleted(repository.New, repository.IncludeDeleted, repository.SoftDelete)
+}
+
+// run returns the sorted entities matching query before offset and limit are applied,
+// and the number of datastore queries the query compiles to
+func (repository InMemoryRepository) run(query Query, excludeDeleted bool) ([]memoryEntity, int, error) {
+	if query.ancestor == nil && repository.GetParentKey() != nil {
+		query = query.Ancestor(repository.GetParentKey())
+	}
+	if excludeDeleted {
+		query = query.Where(DeletedProperty, Eq, time.Time{})
+	}
+	// queries are compiled to be validated like datastore queries
+	queries, err := query.Compile(repository.Kind)
+	if err != nil || len(queries) == 0 {
+		return []memoryEntity{}, len(queries), err
+	}
+	filters, err := query.Filters()
+	if err != nil {
+		return nil, 0, err
+	}
+	required := append([]string{}, query.Fields...)
+	for _, order := range query.Order {
+		required = append(required, strings.TrimPrefix(strings.TrimSpace(order), "-"))
+	}
+	entities := []memoryEntity{}
+	seen := map[string]bool{}
+	for _, entity := range repository.Store.all(repository.Kind, query.ancestor) {
+		if !matches(entity.properties, filters, required) {
+			continue
+		}
+		if len(query.Fields) > 0 {
+			entity.properties = project(entity.properties, query.Fields)
+			if query.distinct {
+				projected := fmt.Sprint(entity.properties)
+				if seen[projected] {
+					continue
+				}
+				seen[projected] = true
+			}
+		}
+		entities = append(entities, entity)
+	}
+	sortEntities(entities, query.Order)
+	return entities, len(queries), nil
+}
+
+// appendAll loads entities into new elements appended to result, a pointer to a slice
+func (repository InMemoryRepository) appendAll(entities []memoryEntity, query Query, result interface{}) error {
+	slice := reflect.ValueOf(result)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return ErrNotASlicePointer
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	for _, entity := range entities {
+		var value reflect.Value
+		if elemType.Kind() == reflect.Ptr {
+			value = reflect.New(elemType.Elem())
+		} else {
+			value = reflect.New(elemType)
+		}
+		if err := load(value.Interface(), entity.properties); err != nil {
+			return err
+		}
+		if elemType.Kind() != reflect.Ptr {
+			value = value.Elem()
+		}
+		slice.Set(reflect.Append(slice, value))
+	}
+	return nil
+}
+
+// paginate applies offset and limit to entities
+func paginate(entities []memoryEntity, offset, limit int) []memoryEntity {
+	if offset >= len(entities) {
+		return []memoryEntity{}
+	}
+	entities = entities[offset:]
+	if limit > 0 && limit < len(entities) {
+		entities = entities[:limit]
+	}
+	return entities
+}
+
+// values returns the values of the property name, multi-valued properties have several values
+func values(properties []datastore.Property, name string) []interface{} {
+	result := []interface{}{}
+	for _, property := range properties {
+		if property.Name == name {
+			result = append(result, property.Value)
+		}
+	}
+	return result
+}
+
+// matches returns true if the properties match every filter and the required properties are set.
+// A multi-valued property matches a filter if one of its values does.
+func matches(properties []datastore.Property, filters []Filter, required []string) bool {
+	for _, name := range required {
+		if len(values(properties, name)) == 0 {
+			return false
+		}
+	}
+	for _, filter := range filters {
+		matched := false
+		for _, value := range values(properties, filter.Field) {
+			if matchesFilter(value, filter) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesFilter(value interface{}, filter Filter) bool {
+	if filter.Operator == In {
+		for _, in := range filter.Value.([]interface{}) {
+			if c, ok := compareValues(value, in); ok && c == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	c, ok := compareValues(value, filter.Value)
+	if !ok {
+		return false
+	}
+	switch filter.Operator {
+	case Eq:
+		return c == 0
+	case Ne:
+		return c != 0
+	case Lt:
+		return c < 0
+	case Lte:
+		return c <= 0
+	case Gt:
+		return c > 0
+	case Gte:
+		return c >= 0
+	}
+	return false
+}
+
+// project keeps the properties listed in fields
+func project(properties []datastore.Property, fields []string) []datastore.Property {
+	projected := []datastore.Property{}
+	for _, property := range properties {
+		for _, field := range fields {
+			if property.Name == field {
+				projected = append(projected, property)
+				break
+			}
+		}
+	}
+	return projected
+}
+
+// sortEntities sorts entities according to orders, then by key.
+// Multi-valued properties are sorted by their smallest value in ascending order
+// and by their largest value in descending order, like in the datastore.
+func sortEntities(entities []memoryEntity, orders []string) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		for _, order := range orders {
+			field, descending := strings.TrimSpace(order), false
+			if strings.HasPrefix(field, "-") {
+				field, descending = strings.TrimSpace(field[1:]), true
+			}
+			a := extremum(values(entities[i].properties, field), descending)
+			b := extremum(values(entities[j].properties, field), descending)
+			if c, _ := compareValues(a, b); c != 0 {
+				return (c < 0) != descending
+			}
+		}
+		return compareKeys(entities[i].key, entities[j].key) < 0
+	})
+}
+
+// extremum returns the largest value if largest is true, else the smallest one
+func extremum(values []interface{}, largest bool) interface{} {
+	var result interface{}
+	for i, value := range values {
+		if c, _ := compareValues(value, result); i == 0 || (c > 0) == largest && c != 0 {
+			result = value
+		}
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func init() {
+	// types of the values of encoded properties
+	gob.Register(time.Time{})
+	gob.Register(&datastore.Key{})
+	gob.Register(datastore.ByteString{})
+	gob.Register(appengine.GeoPoint{})
+	gob.Register(&datastore.Entity{})
+}
+
+// EncodeProperties gob encodes the datastore properties of entity,
+// such as the snapshots of revisions or the cached entities
+func EncodeProperties(entity interface{}) ([]byte, error) {
+	properties, err := save(entity)
+	if err != nil {
+		return nil, err
+	}
+	value := new(bytes.Buffer)
+	if err = gob.NewEncoder(value).Encode(withoutNilPointers(properties)); err != nil {
+		return nil, err
+	}
+	return value.Bytes(), nil
+}
+
+// DecodeProperties decodes the properties encoded by EncodeProperties
+func DecodeProperties(value []byte) ([]datastore.Property, error) {
+	properties := []datastore.Property{}
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&properties); err != nil {
+		return nil, err
+	}
+	return properties, nil
+}
+
+// LoadProperties loads the properties encoded by EncodeProperties into entity
+func LoadProperties(value []byte, entity interface{}) error {
+	properties, err := DecodeProperties(value)
+	if err != nil {
+		return err
+	}
+	return load(entity, properties)
+}
+
+// withoutNilPointers returns a copy of properties where nil pointers, such as
+// the key of an unset Ref, are nil values since gob cannot encode nil pointers
+func withoutNilPointers(properties []datastore.Property) []datastore.Property {
+	result := make([]datastore.Property, len(properties))
+	for i, property := range properties {
+		if value, ok := property.Value.(*datastore.Entity); ok && value != nil {
+			entity := *value
+			entity.Properties = withoutNilPointers(value.Properties)
+			property.Value = &entity
+		}
+		if v := reflect.ValueOf(property.Value); v.Kind() == reflect.Ptr && v.IsNil() {
+			property.Value = nil
+		}
+		result[i] = property
+	}
+	return result
+}
@@ -0,0 +1,437 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Operator is a filter operator
+type Operator string
+
+const (
+	Eq  Operator = "="
+	Lt  Operator = "<"
+	Lte Operator = "<="
+	Gt  Operator = ">"
+	Gte Operator = ">="
+	// Ne and In are not supported by the datastore,
+	// a query using them is split into several queries whose results are merged
+	Ne Operator = "!="
+	In Operator = "in"
+)
+
+// MaxSubqueries is the maximum number of datastore queries
+// a query using Ne or In can be split into
+const MaxSubqueries = 30
+
+var (
+	ErrInvalidOperator   = fmt.Errorf("ErrInvalidOperator")
+	ErrTooManySubqueries = fmt.Errorf("A query cannot be split into more than %d queries", MaxSubqueries)
+)
+
+// Filter is a query filter, the value of an In filter is a []interface{}
+type Filter struct {
+	Field    string
+	Operator Operator
+	Value    interface{}
+}
+
+// Query is a datastore query.
+//
+// Filters can be added with Where :
+//
+//	query := datastore.Where("Age", datastore.Gte, 18).And("Country", datastore.Eq, "FR").OrderBy("-Age")
+//
+// Query.Query holds filters keyed by "Field operator", such as "Username=",
+// they are applied in key order before the filters added with Where.
+type Query struct {
+	Query  map[string]interface{}
+	Order  []string
+	Fields []string
+	Limit  int
+	Offset int
+
+	filters  []Filter
+	ancestor *datastore.Key
+	keysOnly bool
+	distinct bool
+}
+
+// Where returns a query filtering field with operator and value
+func Where(field string, operator Operator, value interface{}) Query {
+	return Query{}.Where(field, operator, value)
+}
+
+// Where adds a filter to the query
+func (query Query) Where(field string, operator Operator, value interface{}) Query {
+	// the full slice expression forces append to copy the filters
+	query.filters = append(query.filters[:len(query.filters):len(query.filters)], Filter{Field: field, Operator: operator, Value: value})
+	return query
+}
+
+// And adds a filter to the query
+func (query Query) And(field string, operator Operator, value interface{}) Query {
+	return query.Where(field, operator, value)
+}
+
+// In adds a filter matching entities whose field equals one of values
+func (query Query) In(field string, values ...interface{}) Query {
+	return query.Where(field, In, values)
+}
+
+// NotEqual adds a filter matching entities whose field is not equal to value
+func (query Query) NotEqual(field string, value interface{}) Query {
+	return query.Where(field, Ne, value)
+}
+
+// Ancestor restricts the query to the descendants of key,
+// it takes precedence over the parent key of a repository
+func (query Query) Ancestor(key *datastore.Key) Query {
+	query.ancestor = key
+	return query
+}
+
+// KeysOnly makes the query return keys instead of entities
+func (query Query) KeysOnly() Query {
+	query.keysOnly = true
+	return query
+}
+
+// Distinct makes a projection query return distinct results
+func (query Query) Distinct() Query {
+	query.distinct = true
+	return query
+}
+
+// OrderBy adds sort orders to the query, "-Field" sorts in descending order
+func (query Query) OrderBy(orders ...string) Query {
+	query.Order = append(query.Order[:len(query.Order):len(query.Order)], orders...)
+	return query
+}
+
+// Project restricts the query to the given fields
+func (query Query) Project(fields ...string) Query {
+	query.Fields = append(query.Fields[:len(query.Fields):len(query.Fields)], fields...)
+	return query
+}
+
+// Filters returns the filters of the query, including the ones of Query.Query
+func (query Query) Filters() ([]Filter, error) {
+	keys := make([]string, 0, len(query.Query))
+	for key := range query.Query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	filters := make([]Filter, 0, len(keys)+len(query.filters))
+	for _, key := range keys {
+		filter, err := parseFilter(key, query.Query[key])
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return append(filters, query.filters...), nil
+}
+
+// GetAncestor returns the ancestor set with Ancestor
+func (query Query) GetAncestor() *datastore.Key {
+	return query.ancestor
+}
+
+// IsKeysOnly returns true if KeysOnly was called
+func (query Query) IsKeysOnly() bool {
+	return query.keysOnly
+}
+
+// IsDistinct returns true if Distinct was called
+func (query Query) IsDistinct() bool {
+	return query.distinct
+}
+
+// parseFilter parses a filter keyed by "Field operator"
+func parseFilter(key string, value interface{}) (Filter, error) {
+	key = strings.TrimSpace(key)
+	if strings.HasSuffix(strings.ToLower(key), " in") {
+		values := reflect.ValueOf(value)
+		if values.Kind() != reflect.Slice {
+			return Filter{}, ErrInvalidOperator
+		}
+		in := make([]interface{}, values.Len())
+		for i := range in {
+			in[i] = values.Index(i).Interface()
+		}
+		return Filter{Field: strings.TrimSpace(key[:len(key)-3]), Operator: In, Value: in}, nil
+	}
+	// two character operators are matched first
+	for _, operator := range []Operator{Lte, Gte, Ne, Eq, Lt, Gt} {
+		if strings.HasSuffix(key, string(operator)) {
+			return Filter{Field: strings.TrimSpace(strings.TrimSuffix(key, string(operator))), Operator: operator, Value: value}, nil
+		}
+	}
+	return Filter{}, ErrInvalidOperator
+}
+
+// Compile compiles the query to datastore queries of kind.
+// The query compiles to a single datastore query unless it uses Ne or In,
+// then each combination of values gets its own query and the results
+// of these queries must be merged. An In filter without values compiles to no query.
+func (query Query) Compile(kind string) ([]*datastore.Query, error) {
+	filters, err := query.Filters()
+	if err != nil {
+		return nil, err
+	}
+	// each set of filters becomes a datastore query
+	sets := [][]Filter{{}}
+	for _, filter := range filters {
+		var alternatives []Filter
+		switch filter.Operator {
+		case Eq, Lt, Lte, Gt, Gte:
+			alternatives = []Filter{filter}
+		case Ne:
+			alternatives = []Filter{{filter.Field, Lt, filter.Value}, {filter.Field, Gt, filter.Value}}
+		case In:
+			values, ok := filter.Value.([]interface{})
+			if !ok {
+				return nil, ErrInvalidOperator
+			}
+			for _, value := range values {
+				alternatives = append(alternatives, Filter{filter.Field, Eq, value})
+			}
+		default:
+			return nil, ErrInvalidOperator
+		}
+		next := [][]Filter{}
+		for _, set := range sets {
+			for _, alternative := range alternatives {
+				next = append(next, append(set[:len(set):len(set)], alternative))
+			}
+		}
+		if len(next) > MaxSubqueries {
+			return nil, ErrTooManySubqueries
+		}
+		sets = next
+	}
+	queries := make([]*datastore.Query, 0, len(sets))
+	for _, set := range sets {
+		q := datastore.NewQuery(kind)
+		for _, filter := range set {
+			q = q.Filter(filter.Field+" "+string(filter.Operator), filter.Value)
+		}
+		if query.ancestor != nil {
+			q = q.Ancestor(query.ancestor)
+		}
+		for _, o := range query.Order {
+			q = q.Order(o)
+		}
+		if len(query.Fields) > 0 {
+			q = q.Project(query.Fields...)
+		}
+		if query.distinct {
+			q = q.Distinct()
+		}
+		if query.keysOnly {
+			q = q.KeysOnly()
+		}
+		if len(sets) == 1 {
+			if query.Limit > 0 {
+				q = q.Limit(query.Limit)
+			}
+			q = q.Offset(query.Offset)
+		} else if query.Limit > 0 {
+			// offset and limit are applied once the results are merged
+			q = q.Limit(query.Offset + query.Limit)
+		}
+		queries = append(queries, q)
+	}
+	return queries, nil
+}
+
+// queryResult is an entity loaded by a query
+type queryResult struct {
+	key   *datastore.Key
+	value reflect.Value
+}
+
+// merge removes duplicated results, sorts them according to orders
+// and applies offset and limit
+func merge(results []queryResult, orders []string, offset, limit int) []queryResult {
+	seen := map[string]bool{}
+	unique := []queryResult{}
+	for _, r := range results {
+		if encoded := r.key.Encode(); !seen[encoded] {
+			seen[encoded] = true
+			unique = append(unique, r)
+		}
+	}
+	sortResults(unique, orders)
+	if offset >= len(unique) {
+		return []queryResult{}
+	}
+	unique = unique[offset:]
+	if limit > 0 && limit < len(unique) {
+		unique = unique[:limit]
+	}
+	return unique
+}
+
+// sortResults sorts results according to orders, then by key
+func sortResults(results []queryResult, orders []string) {
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, order := range orders {
+			field, descending := strings.TrimSpace(order), false
+			if strings.HasPrefix(field, "-") {
+				field, descending = strings.TrimSpace(field[1:]), true
+			}
+			a, _ := propertyValue(results[i].value, field)
+			b, _ := propertyValue(results[j].value, field)
+			if c, _ := compareValues(a, b); c != 0 {
+				return (c < 0) != descending
+			}
+		}
+		return compareKeys(results[i].key, results[j].key) < 0
+	})
+}
+
+// propertyValue returns the value of the datastore property name of a struct,
+// nested struct properties are named "Parent.Child"
+func propertyValue(value reflect.Value, name string) (interface{}, bool) {
+	for _, part := range strings.Split(name, ".") {
+		value = reflect.Indirect(value)
+		if value.Kind() != reflect.Struct {
+			return nil, false
+		}
+		found := false
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			propertyName := field.Name
+			if tag := strings.Split(field.Tag.Get("datastore"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				propertyName = tag
+			}
+			if propertyName == part {
+				value, found = value.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return value.Interface(), true
+}
+
+// compareValues compares two property values, it returns false
+// if the values cannot be compared
+func compareValues(a, b interface{}) (int, bool) {
+	if na, ok := number(a); ok {
+		if nb, ok := number(b); ok {
+			switch {
+			case na < nb:
+				return -1, true
+			case na > nb:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	switch va := a.(type) {
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb), true
+		}
+	case bool:
+		if vb, ok := b.(bool); ok {
+			switch {
+			case va == vb:
+				return 0, true
+			case !va:
+				return -1, true
+			}
+			return 1, true
+		}
+	case time.Time:
+		if vb, ok := b.(time.Time); ok {
+			switch {
+			case va.Before(vb):
+				return -1, true
+			case va.After(vb):
+				return 1, true
+			}
+			return 0, true
+		}
+	case *datastore.Key:
+		if vb, ok := b.(*datastore.Key); ok {
+			return compareKeys(va, vb), true
+		}
+	}
+	return 0, false
+}
+
+// number converts an integer or a float to a float64
+func number(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// compareKeys orders keys by ancestor path, then kind, then ID,
+// keys with int IDs come before keys with string IDs
+func compareKeys(a, b *datastore.Key) int {
+	if a == nil || b == nil {
+		switch {
+		case a == b:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	if c := compareKeys(a.Parent(), b.Parent()); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Kind(), b.Kind()); c != 0 {
+		return c
+	}
+	switch {
+	case a.StringID() == "" && b.StringID() != "":
+		return -1
+	case a.StringID() != "" && b.StringID() == "":
+		return 1
+	case a.IntID() < b.IntID():
+		return -1
+	case a.IntID() > b.IntID():
+		return 1
+	}
+	return strings.Compare(a.StringID(), b.StringID())
+}
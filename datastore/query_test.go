@@ -0,0 +1,83 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore_test
+
+import (
+	"testing"
+
+	"github.com/Mparaiso/appengine/datastore"
+	"github.com/Mparaiso/go-tiger/test"
+)
+
+// Given a query with map filters and filters added with Where
+// Filters should return the map filters in key order, then the other filters
+func TestQuery_Filters(t *testing.T) {
+	query := datastore.Query{Query: map[string]interface{}{
+		"Username=":  "johndoe",
+		"Age >=":     18,
+		"Country in": []string{"FR", "US"},
+	}}.Where("Created", datastore.Lt, 10).NotEqual("Role", "guest")
+	filters, err := query.Filters()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(filters), 5)
+	test.Error(t, filters[0].Field, "Age")
+	test.Error(t, filters[0].Operator, datastore.Gte)
+	test.Error(t, filters[1].Field, "Country")
+	test.Error(t, filters[1].Operator, datastore.In)
+	test.Error(t, len(filters[1].Value.([]interface{})), 2)
+	test.Error(t, filters[2].Field, "Username")
+	test.Error(t, filters[2].Operator, datastore.Eq)
+	test.Error(t, filters[3].Operator, datastore.Lt)
+	test.Error(t, filters[4].Operator, datastore.Ne)
+
+	_, err = datastore.Query{Query: map[string]interface{}{"Username": "johndoe"}}.Filters()
+	test.Error(t, err, datastore.ErrInvalidOperator)
+}
+
+// Given a query using In and NotEqual
+// Compile should return a query for each combination of values
+func TestQuery_Compile(t *testing.T) {
+	queries, err := datastore.Where("Age", datastore.Gte, 18).Compile("users")
+	test.Fatal(t, err, nil)
+	test.Error(t, len(queries), 1)
+
+	queries, err = datastore.Query{}.In("Country", "FR", "US", "DE").NotEqual("Role", "guest").Compile("users")
+	test.Fatal(t, err, nil)
+	test.Error(t, len(queries), 6)
+
+	queries, err = datastore.Query{}.In("Country").Compile("users")
+	test.Fatal(t, err, nil)
+	test.Error(t, len(queries), 0, "In without values should match nothing")
+
+	values := make([]interface{}, datastore.MaxSubqueries+1)
+	_, err = datastore.Query{}.In("Country", values...).Compile("users")
+	test.Error(t, err, datastore.ErrTooManySubqueries)
+}
+
+// Given a query
+// Builder methods should not modify the original query
+func TestQuery_Immutability(t *testing.T) {
+	base := datastore.Where("Age", datastore.Gte, 18)
+	first := base.And("Country", datastore.Eq, "FR")
+	second := base.And("Country", datastore.Eq, "US")
+	filters, _ := first.Filters()
+	test.Error(t, filters[1].Value, "FR")
+	filters, _ = second.Filters()
+	test.Error(t, filters[1].Value, "US")
+	filters, _ = base.Filters()
+	test.Error(t, len(filters), 1)
+	test.Error(t, base.KeysOnly().IsKeysOnly(), true)
+	test.Error(t, base.IsKeysOnly(), false)
+}
@@ -0,0 +1,149 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Ref is a reference to an entity of type T, such as *Author. Only Key is stored,
+// its property is named after the field, such as "Author.Key" :
+//
+//	type Article struct {
+//		ID     int64
+//		Author datastore.Ref[*Author]
+//		Tags   []datastore.Ref[*Tag]
+//	}
+//
+// Entity is loaded by repositories including the field, see Includer
+type Ref[T Entity] struct {
+	Key    *datastore.Key
+	Entity T `datastore:"-" json:",omitempty"`
+}
+
+// NewRef returns a reference to the entity stored at key
+func NewRef[T Entity](key *datastore.Key) Ref[T] {
+	return Ref[T]{Key: key}
+}
+
+// GetKey returns the key of the referenced entity
+func (ref Ref[T]) GetKey() *datastore.Key {
+	return ref.Key
+}
+
+// newEntity returns a new entity of type T
+func (ref *Ref[T]) newEntity() Entity {
+	return reflect.New(reflect.TypeOf((*T)(nil)).Elem().Elem()).Interface().(Entity)
+}
+
+// setEntity sets the referenced entity
+func (ref *Ref[T]) setEntity(entity Entity) {
+	if e, ok := entity.(T); ok {
+		ref.Entity = e
+	}
+}
+
+// reference is implemented by *Ref
+type reference interface {
+	GetKey() *datastore.Key
+	newEntity() Entity
+	setEntity(entity Entity)
+}
+
+var referenceType = reflect.TypeOf((*reference)(nil)).Elem()
+
+// ErrNotAReference is returned when an included field is not a Ref or a slice of Ref
+var ErrNotAReference = fmt.Errorf("This field is not a Ref or a slice of Ref")
+
+// include loads the entities referenced by fields in result, an entity or a pointer
+// to a slice of entities. Fields are matched case insensitively. The referenced entities
+// are loaded by getMulti in a single batch, Entity remains nil for missing entities.
+func include(fields []string, result interface{}, getMulti func(keys []*datastore.Key, dst []Entity) error) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	references := []reference{}
+	value := reflect.Indirect(reflect.ValueOf(result))
+	entities := []reflect.Value{value}
+	if value.Kind() == reflect.Slice {
+		entities = entities[:0]
+		for i := 0; i < value.Len(); i++ {
+			element := value.Index(i)
+			if element.Kind() == reflect.Interface {
+				element = element.Elem()
+			}
+			entities = append(entities, reflect.Indirect(element))
+		}
+	}
+	for _, entity := range entities {
+		if entity.Kind() != reflect.Struct {
+			return ErrNotAReference
+		}
+		for _, name := range fields {
+			field := entity.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, name) })
+			switch {
+			case field.IsValid() && field.Addr().Type().Implements(referenceType):
+				references = append(references, field.Addr().Interface().(reference))
+			case field.IsValid() && field.Kind() == reflect.Slice && reflect.PtrTo(field.Type().Elem()).Implements(referenceType):
+				for i := 0; i < field.Len(); i++ {
+					references = append(references, field.Index(i).Addr().Interface().(reference))
+				}
+			default:
+				return fmt.Errorf("%w : %s", ErrNotAReference, name)
+			}
+		}
+	}
+	keys := []*datastore.Key{}
+	dst := []Entity{}
+	indexes := map[string]int{}
+	for _, ref := range references {
+		if key := ref.GetKey(); key != nil {
+			if _, ok := indexes[key.Encode()]; !ok {
+				indexes[key.Encode()] = len(keys)
+				keys = append(keys, key)
+				dst = append(dst, ref.newEntity())
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	found := make([]bool, len(keys))
+	err := getMulti(keys, dst)
+	errs, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	for i := range keys {
+		if ok && errs[i] != nil {
+			if errs[i] != ErrNoSuchEntity {
+				return errs[i]
+			}
+			continue
+		}
+		found[i] = true
+	}
+	for _, ref := range references {
+		if key := ref.GetKey(); key != nil && found[indexes[key.Encode()]] {
+			ref.setEntity(dst[indexes[key.Encode()]])
+		}
+	}
+	return nil
+}
@@ -17,22 +17,42 @@ package datastore
 import (
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 )
 
-// Repository is a entity repository
+// Repository is a entity repository.
+// The batch operations of named, versioned, soft deletable or locked entities, and the deletions
+// of kinds with cascade rules, run in a single cross-group transaction so that the batch is atomic.
+// The datastore limits cross-group transactions to 25 entity groups, such batches must therefore
+// span at most 25 entity groups, including the ones written by cascade rules, or be split by the caller.
 type Repository interface {
 	Create(entity Entity) error
+	// CreateMulti creates entities, within 25 entity groups if an entity is named
 	CreateMulti(entities ...Entity) error
 	Update(entity Entity) error
+	// UpdateMulti updates entities, within 25 entity groups if an entity is versioned
+	UpdateMulti(entities ...Entity) error
 	Delete(entity Entity) error
+	// DeleteMulti deletes entities, within 25 entity groups if an entity is soft deletable
+	// or locked, or if the kind has cascade rules
+	DeleteMulti(entities ...Entity) error
 	FindByID(id int64, entity Entity) error
+	FindByIDs(ids []int64, entities interface{}) error
+	FindByName(name string, entity Entity) error
 	FindAll(entities interface{}) error
 	FindBy(query Query, result interface{}) error
+	FindPage(query Query, cursor string, result interface{}) (string, error)
 	Count(query Query) (int, error)
+	Restore(entity Entity) error
+	Purge(entity Entity) error
+	RunInTransaction(f func(tx Repository) error, opts *datastore.TransactionOptions) error
 }
 
 // DefaultRepository is the default implementation of Repository
@@ -41,14 +61,54 @@ type DefaultRepository struct {
 	Kind      string
 	Signal    Signal
 	ParentKey *datastore.Key
+	// IncludeDeleted makes queries and lookups return soft deleted entities
+	IncludeDeleted bool
+	// SoftDelete marks the kind as soft deletable. Queries detect SoftDeletableEntity results,
+	// Count, which loads no result, detects soft deletable kinds by New.
+	SoftDelete bool
+	// New creates the entities loaded to be compared with updated entities,
+	// they are created with reflection if not set
+	New func() Entity
+	// cascadeRules are applied to the entities referencing deleted entities, see SetCascade
+	cascadeRules []CascadeRule
+	// Includes lists the Ref fields whose entities are loaded by lookups and queries, see Include
+	Includes []string
+	// pending holds the After* events dispatched during a transaction
+	pending *[]Event
+	// outside is the context of the repository outside of its transaction
+	outside context.Context
+}
+
+// default listeners are shared so that adding them
+// twice to the same signal is a no-op
+var (
+	beforeEntityCreatedListener = ListenerFunc(BeforeEntityCreatedListener)
+	beforeEntityUpdatedListener = ListenerFunc(BeforeEntityUpdatedListener)
+	beforeEntityDeletedListener = ListenerFunc(BeforeEntityDeletedListener)
+)
+
+// DefaultListenerPriority is the priority of the default listeners of a repository,
+// listeners with a higher priority are called before them
+const DefaultListenerPriority = 0
+
+// addDefaultListeners subscribes the default listeners to their events
+func addDefaultListeners(signal Signal) {
+	if subscriptions, ok := signal.(SubscriptionSignal); ok {
+		subscriptions.AddFor(BeforeEntityCreatedEvent{}, beforeEntityCreatedListener, DefaultListenerPriority)
+		subscriptions.AddFor(BeforeEntityUpdatedEvent{}, beforeEntityUpdatedListener, DefaultListenerPriority)
+		subscriptions.AddFor(BeforeEntityDeletedEvent{}, beforeEntityDeletedListener, DefaultListenerPriority)
+		return
+	}
+	signal.Add(beforeEntityCreatedListener)
+	signal.Add(beforeEntityUpdatedListener)
+	signal.Add(beforeEntityDeletedListener)
 }
 
 // NewDefaultRepositoryWithSignal allows to create a repository with an external signal
 func NewDefaultRepositoryWithSignal(ctx context.Context, kind string, signal Signal) *DefaultRepository {
 	defaultRepository := &DefaultRepository{Context: ctx, Kind: kind}
 	defaultRepository.Signal = signal
-	defaultRepository.Signal.Add(ListenerFunc(BeforeEntityCreatedListener))
-	defaultRepository.Signal.Add(ListenerFunc(BeforeEntityUpdatedListener))
+	addDefaultListeners(defaultRepository.Signal)
 	return defaultRepository
 }
 
@@ -56,8 +116,7 @@ func NewDefaultRepositoryWithSignal(ctx context.Context, kind string, signal Sig
 func NewDefaultRepository(ctx context.Context, kind string, listeners ...Listener) *DefaultRepository {
 	defaultRepository := &DefaultRepository{Context: ctx, Kind: kind}
 	defaultRepository.Signal = NewDefaultSignal()
-	defaultRepository.Signal.Add(ListenerFunc(BeforeEntityCreatedListener))
-	defaultRepository.Signal.Add(ListenerFunc(BeforeEntityUpdatedListener))
+	addDefaultListeners(defaultRepository.Signal)
 	for _, listener := range listeners {
 		defaultRepository.Signal.Add(listener)
 	}
@@ -70,12 +129,48 @@ const (
 	ParentKey ContextValue = iota
 )
 
+// DeletedProperty is the indexed datastore property a SoftDeletableEntity
+// saves its deletion time in, queries filter out the entities whose Deleted is not zero
+const DeletedProperty = "Deleted"
+
 var (
 	ErrParentKeyNotFound = fmt.Errorf("ErrParentKeyNotFound")
 	ErrNoSuchEntity      = datastore.ErrNoSuchEntity
 	ErrNotAnEntity       = fmt.Errorf("This value doesn't implement Entity interface")
+	ErrNotASlicePointer  = fmt.Errorf("This value is not a pointer to a slice")
+	ErrInvalidCursor     = fmt.Errorf("ErrInvalidCursor")
+	ErrEmptyName         = fmt.Errorf("A NamedEntity must have a name")
+	ErrNotSoftDeletable  = fmt.Errorf("This value doesn't implement SoftDeletableEntity interface")
+	// ErrNoDeletedProperty is returned by the queries of SoftDeletableEntities
+	// that do not save their deletion time in an indexed Deleted property
+	ErrNoDeletedProperty = fmt.Errorf("A SoftDeletableEntity must save its deletion time in an indexed %s property", DeletedProperty)
+	// ErrEntityExists is returned when a NamedEntity is created with the name of a stored entity
+	ErrEntityExists = fmt.Errorf("An entity with this name already exists")
+	// ErrEntityLocked is returned when a locked LockedEntity is updated or deleted
+	ErrEntityLocked = fmt.Errorf("Entity is locked and cannot be modified")
+	// ErrVersionMismatch is wrapped by ErrVersionConflict,
+	// errors.Is(err, ErrVersionMismatch) is true for any version conflict
+	ErrVersionMismatch = fmt.Errorf("Versions do not match")
 )
 
+// ErrVersionConflict is returned when a VersionedEntity is updated
+// while the stored entity has a different version
+type ErrVersionConflict struct {
+	// Expected is the version of the stored entity
+	Expected int64
+	// Actual is the version of the entity being updated
+	Actual int64
+}
+
+func (err *ErrVersionConflict) Error() string {
+	return fmt.Sprintf("Versions do not match old : %d , new : %d", err.Expected, err.Actual)
+}
+
+// Unwrap returns ErrVersionMismatch
+func (err *ErrVersionConflict) Unwrap() error {
+	return ErrVersionMismatch
+}
+
 // SetParentKey sets the parent key
 func (repository *DefaultRepository) SetParentKey(key *datastore.Key) {
 	repository.ParentKey = key
@@ -86,25 +181,116 @@ func (repository DefaultRepository) GetParentKey() *datastore.Key {
 	return repository.ParentKey
 }
 
-// Create an entity
+// SetNew sets the factory of the entities loaded by the repository
+func (repository *DefaultRepository) SetNew(New func() Entity) {
+	repository.New = New
+}
+
+// SetCascade sets the rules applied to the entities referencing deleted entities,
+// deletions then run in a cross-group transaction, see CascadeRule.
+// An error wrapping ErrInvalidCascadeRule is returned if a rule is invalid.
+func (repository *DefaultRepository) SetCascade(rules ...CascadeRule) error {
+	if err := validateCascade(rules); err != nil {
+		return err
+	}
+	repository.cascadeRules = rules
+	return nil
+}
+
+// Include returns a copy of the repository loading the entities referenced by the Ref fields
+// of the entities it finds, such as "Author" or "Tags", in a single batch per lookup or query
+func (repository DefaultRepository) Include(fields ...string) Repository {
+	repository.Includes = fields
+	return &repository
+}
+
+// include loads the entities referenced by the Includes fields of result
+func (repository DefaultRepository) include(result interface{}) error {
+	return include(repository.Includes, result, func(keys []*datastore.Key, dst []Entity) error {
+		return datastore.GetMulti(repository.Context, keys, dst)
+	})
+}
+
+// Exists returns true if an entity is stored at key, whatever its kind
+func (repository DefaultRepository) Exists(key *datastore.Key) (bool, error) {
+	err := datastore.Get(repository.Context, key, &datastore.PropertyList{})
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Key returns the datastore key of an entity,
+// a NamedEntity is keyed by its name
+func (repository DefaultRepository) Key(entity Entity) *datastore.Key {
+	if named, ok := entity.(NamedEntity); ok {
+		return datastore.NewKey(repository.Context, repository.Kind, named.GetName(), 0, repository.GetParentKey())
+	}
+	return datastore.NewKey(repository.Context, repository.Kind, "", entity.GetID(), repository.GetParentKey())
+}
+
+// Create an entity, an ID is allocated unless the entity is a NamedEntity.
+// A NamedEntity is created in a transaction, ErrEntityExists is returned
+// if an entity is stored with the same name.
 func (repository DefaultRepository) Create(entity Entity) error {
-	parentKey := repository.GetParentKey()
-	low, _, err := datastore.AllocateIDs(repository.Context, repository.Kind, parentKey, 1)
+	var err error
+	if named, ok := entity.(NamedEntity); ok {
+		if named.GetName() == "" {
+			return ErrEmptyName
+		}
+		return repository.runInTransaction(func(tx DefaultRepository) error {
+			if err := tx.notExisting([]*datastore.Key{tx.Key(entity)}); err != nil {
+				return err
+			}
+			return tx.create(entity)
+		}, nil)
+	}
+	var low int64
+	low, _, err = datastore.AllocateIDs(repository.Context, repository.Kind, repository.GetParentKey(), 1)
+	if err != nil {
+		return err
+	}
+	entity.SetID(low)
+	return repository.create(entity)
+}
 
-	if err == nil {
-		entity.SetID(low)
-		err = repository.Dispatch(BeforeEntityCreatedEvent{Context: repository.Context, Entity: entity})
-		if err != nil {
-			return err
+func (repository DefaultRepository) create(entity Entity) error {
+	key := repository.Key(entity)
+	err := repository.Dispatch(BeforeEntityCreatedEvent{Context: repository.Context, Key: key, Entity: entity})
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(repository.Context, key, entity)
+	if err != nil {
+		return err
+	}
+	return repository.dispatchAfter(AfterEntityCreatedEvent{Context: repository.Context, Key: key, Entity: entity})
+}
+
+// notExisting returns ErrEntityExists if an entity is stored at one of keys
+func (repository DefaultRepository) notExisting(keys []*datastore.Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	err := datastore.GetMulti(repository.Context, keys, make([]datastore.PropertyList, len(keys)))
+	errs, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	for i := range keys {
+		if !ok || errs[i] == nil {
+			return ErrEntityExists
 		}
-		key := datastore.NewKey(repository.Context, repository.Kind, "", entity.GetID(), parentKey)
-		_, err = datastore.Put(repository.Context, key, entity)
-		if err != nil {
-			return err
+		if errs[i] != ErrNoSuchEntity {
+			return errs[i]
 		}
-		err = repository.Dispatch(AfterEntityCreatedEvent{Context: repository.Context, Entity: entity})
 	}
-	return err
+	return nil
+}
+
+// GetSignal returns the signal of the repository
+func (repository DefaultRepository) GetSignal() Signal {
+	return repository.Signal
 }
 
 // Dispatch dispatches an event to the Signal if the Signal is not null
@@ -115,20 +301,99 @@ func (repository DefaultRepository) Dispatch(event Event) error {
 	return nil
 }
 
-// CreateMulti persist multiple entities into the datastore
+// dispatchAfter dispatches an After* event, the event is deferred
+// until commit if the repository is bound to a transaction
+func (repository DefaultRepository) dispatchAfter(event Event) error {
+	if repository.pending != nil {
+		*repository.pending = append(*repository.pending, event)
+		return nil
+	}
+	return repository.Dispatch(event)
+}
+
+// RunInTransaction runs f in a datastore transaction. tx is a repository bound to the
+// transaction context, with the same Kind, ParentKey and Signal.
+// After* events are only dispatched once the transaction is committed, so listeners
+// are not called twice when the transaction is retried.
+// If the repository is already bound to a transaction, f joins that transaction.
+func (repository DefaultRepository) RunInTransaction(f func(tx Repository) error, opts *datastore.TransactionOptions) error {
+	return repository.runInTransaction(func(tx DefaultRepository) error { return f(tx) }, opts)
+}
+
+func (repository DefaultRepository) runInTransaction(f func(tx DefaultRepository) error, opts *datastore.TransactionOptions) error {
+	if repository.pending != nil {
+		return f(repository)
+	}
+	var pending *[]Event
+	err := datastore.RunInTransaction(repository.Context, func(ctx context.Context) error {
+		// a retry discards the events of the previous attempt
+		pending = &[]Event{}
+		tx := repository
+		tx.Context = ctx
+		tx.pending = pending
+		tx.outside = repository.Context
+		return f(tx)
+	}, opts)
+	if err != nil {
+		return err
+	}
+	for _, event := range *pending {
+		if err = repository.Dispatch(withContext(event, repository.Context)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateMulti persist multiple entities into the datastore.
+// Named entities are created in a cross-group transaction, ErrEntityExists is returned
+// if an entity is stored with the name of one of them.
 func (repository DefaultRepository) CreateMulti(entities ...Entity) error {
-	parentKey := repository.GetParentKey()
-	low, _, err := datastore.AllocateIDs(repository.Context, repository.Kind, parentKey, len(entities))
+	for _, entity := range entities {
+		if _, ok := entity.(NamedEntity); ok {
+			return repository.runInTransaction(func(tx DefaultRepository) error {
+				return tx.createMulti(entities)
+			}, &datastore.TransactionOptions{XG: true})
+		}
+	}
+	return repository.createMulti(entities)
+}
+
+func (repository DefaultRepository) createMulti(entities []Entity) error {
+	var (
+		low int64
+		err error
+	)
+	unnamed := 0
+	named := []*datastore.Key{}
+	for _, entity := range entities {
+		if n, ok := entity.(NamedEntity); !ok {
+			unnamed++
+		} else if n.GetName() == "" {
+			return ErrEmptyName
+		} else {
+			named = append(named, repository.Key(entity))
+		}
+	}
+	if err = repository.notExisting(named); err != nil {
+		return err
+	}
+	if unnamed > 0 {
+		low, _, err = datastore.AllocateIDs(repository.Context, repository.Kind, repository.GetParentKey(), unnamed)
+	}
 	keys := []*datastore.Key{}
 	if err == nil {
-		for i, entity := range entities {
+		for _, entity := range entities {
 			if e, ok := entity.(Entity); ok {
-				e.SetID(low + int64(i))
-				err = repository.Dispatch(BeforeEntityCreatedEvent{Context: repository.Context, Entity: e})
+				if _, ok := e.(NamedEntity); !ok {
+					e.SetID(low)
+					low++
+				}
+				keys = append(keys, repository.Key(e))
+				err = repository.Dispatch(BeforeEntityCreatedEvent{Context: repository.Context, Key: keys[len(keys)-1], Entity: e})
 				if err != nil {
 					return err
 				}
-				keys = append(keys, datastore.NewKey(repository.Context, repository.Kind, "", e.GetID(), parentKey))
 			} else {
 				return ErrNotAnEntity
 			}
@@ -137,8 +402,8 @@ func (repository DefaultRepository) CreateMulti(entities ...Entity) error {
 		if err != nil {
 			return err
 		}
-		for _, entity := range entities {
-			err = repository.Dispatch(AfterEntityCreatedEvent{Context: repository.Context, Entity: entity})
+		for i, entity := range entities {
+			err = repository.dispatchAfter(AfterEntityCreatedEvent{Context: repository.Context, Key: keys[i], Entity: entity})
 			if err != nil {
 				return err
 			}
@@ -147,17 +412,45 @@ func (repository DefaultRepository) CreateMulti(entities ...Entity) error {
 	return err
 }
 
-// Update an entity
+// Update an entity. The stored version of a VersionedEntity is
+// compared and incremented in a transaction.
 func (repository DefaultRepository) Update(entity Entity) error {
-	parentKey := repository.GetParentKey()
+	versioned, ok := entity.(VersionedEntity)
+	if !ok {
+		return repository.update(entity)
+	}
+	version := versioned.GetVersion()
+	err := repository.runInTransaction(func(tx DefaultRepository) error {
+		// listeners increment the version, restore it when the transaction is retried
+		versioned.SetVersion(version)
+		return tx.update(entity)
+	}, nil)
+	if err != nil {
+		versioned.SetVersion(version)
+	}
+	return err
+}
 
-	key := datastore.NewKey(repository.Context, repository.Kind, "", entity.GetID(), parentKey)
-	old := reflect.New(reflect.Indirect(reflect.ValueOf(entity)).Type()).Interface()
-	err := datastore.Get(repository.Context, key, old)
+// newEntity returns a new entity of the type of entity
+func (repository DefaultRepository) newEntity(entity Entity) Entity {
+	return newEntity(repository.New, entity)
+}
+
+func newEntity(factory func() Entity, entity Entity) Entity {
+	if factory != nil {
+		return factory()
+	}
+	return reflect.New(reflect.Indirect(reflect.ValueOf(entity)).Type()).Interface().(Entity)
+}
+
+func (repository DefaultRepository) update(entity Entity) error {
+	key := repository.Key(entity)
+	old := repository.newEntity(entity)
+	err := repository.get(key, old)
 	if err != nil {
 		return err
 	}
-	err = repository.Dispatch(BeforeEntityUpdatedEvent{Context: repository.Context, Old: old.(Entity), New: entity})
+	err = repository.Dispatch(BeforeEntityUpdatedEvent{Context: repository.Context, Key: key, Old: old, New: entity})
 	if err != nil {
 		return err
 	}
@@ -165,93 +458,685 @@ func (repository DefaultRepository) Update(entity Entity) error {
 	if err != nil {
 		return err
 	}
-	return repository.Dispatch(AfterEntityUpdatedEvent{Context: repository.Context, Old: old.(Entity), New: entity})
+	return repository.dispatchAfter(AfterEntityUpdatedEvent{Context: repository.Context, Key: key, Old: old.(Entity), New: entity})
+
+}
+
+// UpdateMulti updates multiple entities. Errors are reported in an appengine.MultiError
+// indexed like entities, nothing is written if an entity is missing or a listener fails.
+// Versioned entities are updated in a cross-group transaction, limited to 25 entity groups.
+func (repository DefaultRepository) UpdateMulti(entities ...Entity) error {
+	versions := map[int]int64{}
+	for i, entity := range entities {
+		if versioned, ok := entity.(VersionedEntity); ok {
+			versions[i] = versioned.GetVersion()
+		}
+	}
+	if len(versions) == 0 {
+		return repository.updateMulti(entities)
+	}
+	restore := func() {
+		for i, version := range versions {
+			entities[i].(VersionedEntity).SetVersion(version)
+		}
+	}
+	err := repository.runInTransaction(func(tx DefaultRepository) error {
+		restore()
+		return tx.updateMulti(entities)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		restore()
+	}
+	return err
+}
 
+func (repository DefaultRepository) updateMulti(entities []Entity) error {
+	keys := make([]*datastore.Key, len(entities))
+	olds := make([]Entity, len(entities))
+	for i, entity := range entities {
+		keys[i] = repository.Key(entity)
+		olds[i] = repository.newEntity(entity)
+	}
+	errs, err := repository.getMulti(keys, olds)
+	if err != nil {
+		return err
+	}
+	for i, entity := range entities {
+		if errs[i] == nil {
+			errs[i] = repository.Dispatch(BeforeEntityUpdatedEvent{Context: repository.Context, Key: keys[i], Old: olds[i], New: entity})
+		}
+	}
+	if hasErrors(errs) {
+		return errs
+	}
+	if _, err = datastore.PutMulti(repository.Context, keys, entities); err != nil {
+		return err
+	}
+	for i, entity := range entities {
+		err = repository.dispatchAfter(AfterEntityUpdatedEvent{Context: repository.Context, Key: keys[i], Old: olds[i], New: entity})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Delete an entity
+// DeleteMulti deletes multiple entities. Errors are reported in an appengine.MultiError
+// indexed like entities, nothing is written if a listener fails.
+// Soft deletable entities are marked as deleted in a cross-group transaction, limited to 25 entity groups,
+// soft deletable and locked entities are loaded before listeners are called.
+func (repository DefaultRepository) DeleteMulti(entities ...Entity) error {
+	if len(repository.cascadeRules) == 0 && !anyLoadsBeforeDelete(entities) {
+		return repository.deleteMulti(entities)
+	}
+	return repository.runInTransaction(func(tx DefaultRepository) error {
+		return tx.deleteMulti(entities)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+func (repository DefaultRepository) deleteMulti(entities []Entity) error {
+	var (
+		softIndexes, hardIndexes, loadIndexes []int
+		softKeys, hardKeys, loadKeys          []*datastore.Key
+		softEntities, loadEntities            []Entity
+	)
+	keys := make([]*datastore.Key, len(entities))
+	for i, entity := range entities {
+		key := repository.Key(entity)
+		keys[i] = key
+		if loadsBeforeDelete(entity) {
+			loadIndexes = append(loadIndexes, i)
+			loadKeys = append(loadKeys, key)
+			loadEntities = append(loadEntities, entity)
+		}
+		if _, ok := entity.(SoftDeletableEntity); ok {
+			softIndexes = append(softIndexes, i)
+			softKeys = append(softKeys, key)
+			softEntities = append(softEntities, entity)
+		} else {
+			hardIndexes = append(hardIndexes, i)
+			hardKeys = append(hardKeys, key)
+		}
+	}
+	errs := make(appengine.MultiError, len(entities))
+	if len(loadKeys) > 0 {
+		loadErrs, err := repository.getMulti(loadKeys, loadEntities)
+		if err != nil {
+			return err
+		}
+		spread(errs, loadErrs, loadIndexes)
+	}
+	for i, entity := range entities {
+		if errs[i] == nil {
+			errs[i] = repository.Dispatch(BeforeEntityDeletedEvent{Context: repository.Context, Key: keys[i], Entity: entity})
+		}
+	}
+	for i, entity := range entities {
+		if errs[i] == nil {
+			_, soft := entity.(SoftDeletableEntity)
+			errs[i] = repository.cascade(keys[i], !soft)
+		}
+	}
+	if hasErrors(errs) {
+		return errs
+	}
+	if len(softKeys) > 0 {
+		now := time.Now()
+		for _, entity := range softEntities {
+			entity.(SoftDeletableEntity).SetDeleted(now)
+		}
+		if _, err := datastore.PutMulti(repository.Context, softKeys, softEntities); err != nil {
+			if !spread(errs, err, softIndexes) {
+				return err
+			}
+		}
+	}
+	if len(hardKeys) > 0 {
+		if err := datastore.DeleteMulti(repository.Context, hardKeys); err != nil {
+			if !spread(errs, err, hardIndexes) {
+				return err
+			}
+		}
+	}
+	if hasErrors(errs) {
+		return errs
+	}
+	for i, entity := range entities {
+		if err := repository.dispatchAfter(AfterEntityDeletedEvent{Context: repository.Context, Key: keys[i], Entity: entity}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadsBeforeDelete returns true if the stored entity must be loaded
+// before listeners are called on deletion
+func loadsBeforeDelete(entity Entity) bool {
+	_, soft := entity.(SoftDeletableEntity)
+	_, locked := entity.(LockedEntity)
+	return soft || locked
+}
+
+// anyLoadsBeforeDelete returns true if an entity is loaded before it is deleted
+func anyLoadsBeforeDelete(entities []Entity) bool {
+	for _, entity := range entities {
+		if loadsBeforeDelete(entity) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete an entity, a SoftDeletableEntity is marked as deleted
+// instead of being removed from the datastore
 func (repository DefaultRepository) Delete(entity Entity) error {
+	if _, ok := entity.(SoftDeletableEntity); ok {
+		return repository.softDelete(entity)
+	}
+	return repository.Purge(entity)
+}
+
+func (repository DefaultRepository) softDelete(entity Entity) error {
+	return repository.runInTransaction(func(tx DefaultRepository) error {
+		key := tx.Key(entity)
+		if err := tx.get(key, entity); err != nil {
+			return err
+		}
+		if err := tx.Dispatch(BeforeEntityDeletedEvent{Context: tx.Context, Key: key, Entity: entity}); err != nil {
+			return err
+		}
+		if err := tx.cascade(key, false); err != nil {
+			return err
+		}
+		entity.(SoftDeletableEntity).SetDeleted(time.Now())
+		if _, err := datastore.Put(tx.Context, key, entity); err != nil {
+			return err
+		}
+		return tx.dispatchAfter(AfterEntityDeletedEvent{Context: tx.Context, Key: key, Entity: entity})
+	}, repository.deleteOptions())
+}
+
+// cascade applies the cascade rules to the entities referencing the deleted entity of key,
+// the entity is removed from the datastore unless it is soft deleted
+func (repository DefaultRepository) cascade(key *datastore.Key, removed bool) error {
+	if len(repository.cascadeRules) == 0 {
+		return nil
+	}
+	return cascade(defaultCascadeStore{repository}, repository.cascadeRules, key, removed)
+}
+
+// deleteOptions returns the options of the transactions of deletions,
+// cascade rules may write entities of other entity groups
+func (repository DefaultRepository) deleteOptions() *datastore.TransactionOptions {
+	if len(repository.cascadeRules) > 0 {
+		return &datastore.TransactionOptions{XG: true}
+	}
+	return nil
+}
+
+// Restore restores a soft deleted entity
+func (repository DefaultRepository) Restore(entity Entity) error {
+	deletable, ok := entity.(SoftDeletableEntity)
+	if !ok {
+		return ErrNotSoftDeletable
+	}
+	return repository.runInTransaction(func(tx DefaultRepository) error {
+		key := tx.Key(entity)
+		if err := datastore.Get(tx.Context, key, entity); err != nil {
+			return err
+		}
+		if err := tx.Dispatch(BeforeEntityRestoredEvent{Context: tx.Context, Key: key, Entity: entity}); err != nil {
+			return err
+		}
+		deletable.SetDeleted(time.Time{})
+		if _, err := datastore.Put(tx.Context, key, entity); err != nil {
+			return err
+		}
+		return tx.dispatchAfter(AfterEntityRestoredEvent{Context: tx.Context, Key: key, Entity: entity})
+	}, nil)
+}
+
+// Purge removes an entity from the datastore, even if it is soft deletable.
+// A LockedEntity is loaded in a transaction so that listeners check the stored entity
+func (repository DefaultRepository) Purge(entity Entity) error {
+	if _, ok := entity.(LockedEntity); ok {
+		return repository.runInTransaction(func(tx DefaultRepository) error {
+			if err := datastore.Get(tx.Context, tx.Key(entity), entity); err != nil {
+				return err
+			}
+			return tx.purge(entity)
+		}, repository.deleteOptions())
+	}
+	if len(repository.cascadeRules) > 0 {
+		return repository.runInTransaction(func(tx DefaultRepository) error {
+			return tx.purge(entity)
+		}, repository.deleteOptions())
+	}
+	return repository.purge(entity)
+}
+
+func (repository DefaultRepository) purge(entity Entity) error {
 	var err error
-	parentKey := repository.GetParentKey()
-	key := datastore.NewKey(repository.Context, repository.Kind, "", entity.GetID(), parentKey)
-	err = repository.Dispatch(BeforeEntityDeletedEvent{Context: repository.Context, Entity: entity})
+	key := repository.Key(entity)
+	err = repository.Dispatch(BeforeEntityDeletedEvent{Context: repository.Context, Key: key, Entity: entity})
 	if err != nil {
 		return err
 	}
+	if err = repository.cascade(key, true); err != nil {
+		return err
+	}
 	err = datastore.Delete(repository.Context, key)
 	if err != nil {
 		return err
 	}
-	return repository.Dispatch(AfterEntityDeletedEvent{Context: repository.Context, Entity: entity})
+	return repository.dispatchAfter(AfterEntityDeletedEvent{Context: repository.Context, Key: key, Entity: entity})
+}
+
+// get loads an entity, a soft deleted entity is not found
+// unless IncludeDeleted is set
+func (repository DefaultRepository) get(key *datastore.Key, entity interface{}) error {
+	if err := datastore.Get(repository.Context, key, entity); err != nil {
+		return err
+	}
+	if deletable, ok := entity.(SoftDeletableEntity); ok && !repository.IncludeDeleted && !deletable.GetDeleted().IsZero() {
+		return ErrNoSuchEntity
+	}
+	return nil
+}
+
+// excludesDeleted returns true if soft deleted entities must be filtered out
+// of a query loading values into result
+func (repository DefaultRepository) excludesDeleted(result interface{}) (bool, error) {
+	return excludesDeleted(result, repository.IncludeDeleted, repository.SoftDelete)
+}
+
+// countExcludesDeleted returns true if soft deleted entities must be filtered out of a count.
+// Count loads no result to detect soft deletable entities, the kind is soft deletable
+// if SoftDelete is set or if New creates a SoftDeletableEntity.
+func (repository DefaultRepository) countExcludesDeleted() (bool, error) {
+	return countExcludesDeleted(repository.New, repository.IncludeDeleted, repository.SoftDelete)
+}
+
+func countExcludesDeleted(New func() Entity, includeDeleted, softDelete bool) (bool, error) {
+	if New == nil {
+		return !includeDeleted && softDelete, nil
+	}
+	return excludesDeleted(New(), includeDeleted, softDelete)
+}
+
+// excludesDeleted returns true if soft deleted entities must be filtered out of a query loading
+// values into result, ErrNoDeletedProperty if the values cannot be filtered
+func excludesDeleted(result interface{}, includeDeleted, softDelete bool) (bool, error) {
+	if includeDeleted {
+		return false, nil
+	}
+	if prototype := softDeletablePrototype(result); prototype != nil {
+		return true, checkDeletedProperty(prototype)
+	}
+	return softDelete, nil
+}
+
+// softDeletablePrototype returns a new SoftDeletableEntity of the type of result
+// or of the elements of result, or nil if they are not soft deletable
+func softDeletablePrototype(result interface{}) interface{} {
+	t := reflect.TypeOf(result)
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice) {
+		if t.Kind() == reflect.Ptr && t.Implements(softDeletableEntityType) {
+			return reflect.New(t.Elem()).Interface()
+		}
+		t = t.Elem()
+	}
+	if t != nil && reflect.PtrTo(t).Implements(softDeletableEntityType) {
+		return reflect.New(t).Interface()
+	}
+	return nil
+}
+
+// checkDeletedProperty returns ErrNoDeletedProperty unless entity saves its deletion time
+// in an indexed Deleted property, which queries filter on to exclude soft deleted entities
+func checkDeletedProperty(entity interface{}) error {
+	properties, err := save(entity)
+	if err != nil {
+		return err
+	}
+	for _, property := range properties {
+		if _, ok := property.Value.(time.Time); ok && property.Name == DeletedProperty && !property.NoIndex {
+			return nil
+		}
+	}
+	return ErrNoDeletedProperty
 }
 
+// getMulti loads multiple entities into dst, errors are reported in an appengine.MultiError
+// indexed like keys. Soft deleted entities are not found unless IncludeDeleted is set.
+func (repository DefaultRepository) getMulti(keys []*datastore.Key, dst interface{}) (appengine.MultiError, error) {
+	errs := make(appengine.MultiError, len(keys))
+	err := datastore.GetMulti(repository.Context, keys, dst)
+	if multi, ok := err.(appengine.MultiError); ok {
+		copy(errs, multi)
+	} else if err != nil {
+		return nil, err
+	}
+	if repository.IncludeDeleted {
+		return errs, nil
+	}
+	values := reflect.ValueOf(dst)
+	for i := range keys {
+		value := values.Index(i)
+		if value.Kind() != reflect.Ptr && value.Kind() != reflect.Interface {
+			value = value.Addr()
+		}
+		if deletable, ok := value.Interface().(SoftDeletableEntity); ok && errs[i] == nil && !deletable.GetDeleted().IsZero() {
+			errs[i] = ErrNoSuchEntity
+		}
+	}
+	return errs, nil
+}
+
+// spread copies the errors of err, an appengine.MultiError, into errs
+// at the given indexes. It returns false if err is not an appengine.MultiError
+func spread(errs appengine.MultiError, err error, indexes []int) bool {
+	multi, ok := err.(appengine.MultiError)
+	if !ok {
+		return false
+	}
+	for i, index := range indexes {
+		errs[index] = multi[i]
+	}
+	return true
+}
+
+// hasErrors returns true if errs holds at least one error
+func hasErrors(errs appengine.MultiError) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+var softDeletableEntityType = reflect.TypeOf((*SoftDeletableEntity)(nil)).Elem()
+
 // FindByID gets an entity by id
 func (repository DefaultRepository) FindByID(id int64, entity Entity) error {
-	var err error
-	parentKey := repository.GetParentKey()
+	key := datastore.NewKey(repository.Context, repository.Kind, "", id, repository.GetParentKey())
+	if err := repository.get(key, entity); err != nil {
+		return err
+	}
+	return repository.include(entity)
+}
+
+// FindByIDs gets entities by ids into entities, a pointer to a slice resized to len(ids).
+// Missing entities are reported in an appengine.MultiError indexed like ids.
+func (repository DefaultRepository) FindByIDs(ids []int64, entities interface{}) error {
+	slice := reflect.ValueOf(entities)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return ErrNotASlicePointer
+	}
+	slice = slice.Elem()
+	slice.Set(reflect.MakeSlice(slice.Type(), len(ids), len(ids)))
+	if elemType := slice.Type().Elem(); elemType.Kind() == reflect.Ptr {
+		for i := range ids {
+			slice.Index(i).Set(reflect.New(elemType.Elem()))
+		}
+	}
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = datastore.NewKey(repository.Context, repository.Kind, "", id, repository.GetParentKey())
+	}
+	errs, err := repository.getMulti(keys, slice.Interface())
 	if err != nil {
 		return err
 	}
-	key := datastore.NewKey(repository.Context, repository.Kind, "", id, parentKey)
-	return datastore.Get(repository.Context, key, entity)
+	if hasErrors(errs) {
+		return errs
+	}
+	return repository.include(entities)
 }
 
-// FindAll returns all entities
-func (repository DefaultRepository) FindAll(entities interface{}) error {
-	parentKey := repository.GetParentKey()
-	query := datastore.NewQuery(repository.Kind)
-	if parentKey != nil {
-		query = query.Ancestor(parentKey)
+// FindByName gets a NamedEntity by name
+func (repository DefaultRepository) FindByName(name string, entity Entity) error {
+	key := datastore.NewKey(repository.Context, repository.Kind, name, 0, repository.GetParentKey())
+	if err := repository.get(key, entity); err != nil {
+		return err
 	}
-	_, err := query.GetAll(repository.Context, entities)
-	return err
+	if named, ok := entity.(NamedEntity); ok {
+		named.SetName(name)
+	}
+	return repository.include(entity)
 }
 
-type Query struct {
-	Query  map[string]interface{}
-	Order  []string
-	Fields []string
-	Limit  int
-	Offset int
+// FindAll returns all entities
+func (repository DefaultRepository) FindAll(entities interface{}) error {
+	return repository.FindBy(Query{}, entities)
 }
 
+// FindBy fetches the entities matching query into result, a pointer to a slice.
+// The keys of a keys-only query are fetched into result if it is a *[]*datastore.Key.
 func (repository DefaultRepository) FindBy(
 	query Query,
 	result interface{}) error {
-	parentKey := repository.GetParentKey()
-	q := repository.createQuery(query)
-	if parentKey != nil {
-		q = q.Ancestor(parentKey)
+	excludeDeleted, err := repository.excludesDeleted(result)
+	if err != nil {
+		return err
 	}
-	_, err := q.GetAll(repository.Context, result)
-	return err
+	queries, err := repository.compile(query, excludeDeleted)
+	if err != nil {
+		return err
+	}
+	keys, err := repository.getAll(queries, query, result)
+	if err != nil {
+		return err
+	}
+	if query.keysOnly {
+		if dst, ok := result.(*[]*datastore.Key); ok {
+			*dst = keys
+		}
+		return nil
+	}
+	return repository.include(result)
 }
 
-// Count returns the object count given a query
-func (repository DefaultRepository) Count(
-	query Query) (int, error) {
-	parentKey := repository.GetParentKey()
-	q := repository.createQuery(query)
-	if parentKey != nil {
-		q = q.Ancestor(parentKey)
+// compile compiles a query scoped to the parent key of the repository,
+// soft deleted entities are filtered out if excludeDeleted is true
+func (repository DefaultRepository) compile(query Query, excludeDeleted bool) ([]*datastore.Query, error) {
+	if query.ancestor == nil && repository.GetParentKey() != nil {
+		query = query.Ancestor(repository.GetParentKey())
+	}
+	if excludeDeleted {
+		query = query.Where(DeletedProperty, Eq, time.Time{})
 	}
-	return q.Count(repository.Context)
+	return query.Compile(repository.Kind)
 }
 
-func (repository DefaultRepository) createQuery(query Query) *datastore.Query {
-	q := datastore.NewQuery(repository.Kind)
-	for key, value := range query.Query {
-		q = q.Filter(key, value)
+// getAll runs the queries compiled from query and loads the merged results into dst
+func (repository DefaultRepository) getAll(queries []*datastore.Query, query Query, dst interface{}) ([]*datastore.Key, error) {
+	if len(queries) == 1 {
+		return queries[0].GetAll(repository.Context, dst)
 	}
-	for _, o := range query.Order {
-		q = q.Order(o)
+	slice := reflect.ValueOf(dst)
+	if !query.keysOnly && (slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice) {
+		return nil, ErrNotASlicePointer
 	}
-	if len(query.Fields) > 0 {
-		q = q.Project(query.Fields...)
+	results := []queryResult{}
+	for _, q := range queries {
+		var values reflect.Value
+		var subDst interface{}
+		if !query.keysOnly {
+			values = reflect.New(slice.Elem().Type())
+			subDst = values.Interface()
+		}
+		keys, err := q.GetAll(repository.Context, subDst)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			r := queryResult{key: key}
+			if !query.keysOnly {
+				r.value = values.Elem().Index(i)
+			}
+			results = append(results, r)
+		}
 	}
+	results = merge(results, query.Order, query.Offset, query.Limit)
+	keys := make([]*datastore.Key, len(results))
+	for i, r := range results {
+		keys[i] = r.key
+	}
+	if !query.keysOnly {
+		merged := reflect.MakeSlice(slice.Elem().Type(), 0, len(results))
+		for _, r := range results {
+			merged = reflect.Append(merged, r.value)
+		}
+		slice.Elem().Set(merged)
+	}
+	return keys, nil
+}
+
+// FindPage fetches at most query.Limit entities into result, a pointer to a slice,
+// starting at cursor. An empty cursor starts from the first entity.
+// It returns an opaque cursor to the next page, or an empty string when there is
+// no next page. Queries using Ne or In run as several queries whose results are merged,
+// their cursors are positions in the merged results, each page runs the queries from the first entity.
+func (repository DefaultRepository) FindPage(
+	query Query,
+	cursor string,
+	result interface{}) (string, error) {
+	slice := reflect.ValueOf(result)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return "", ErrNotASlicePointer
+	}
+	slice = slice.Elem()
+	excludeDeleted, err := repository.excludesDeleted(result)
+	if err != nil {
+		return "", err
+	}
+	queries, err := repository.compile(query, excludeDeleted)
+	if err != nil {
+		return "", err
+	}
+	switch len(queries) {
+	case 0:
+		return "", nil
+	case 1:
+	default:
+		return repository.findMergedPage(query, cursor, result)
+	}
+	q := queries[0]
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return "", ErrInvalidCursor
+		}
+		q = q.Start(start)
+	}
+	elemType := slice.Type().Elem()
+	iterator := q.Run(repository.Context)
+	count := 0
+	for {
+		var value reflect.Value
+		if elemType.Kind() == reflect.Ptr {
+			value = reflect.New(elemType.Elem())
+		} else {
+			value = reflect.New(elemType)
+		}
+		_, err := iterator.Next(value.Interface())
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if elemType.Kind() != reflect.Ptr {
+			value = value.Elem()
+		}
+		slice.Set(reflect.Append(slice, value))
+		count++
+	}
+	if err = repository.include(result); err != nil {
+		return "", err
+	}
+	if query.Limit <= 0 || count < query.Limit {
+		return "", nil
+	}
+	next, err := iterator.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
+
+// mergedCursorPrefix prefixes the cursors of the queries using Ne or In,
+// so that they cannot be mistaken for datastore cursors
+const mergedCursorPrefix = "merged:"
+
+// findMergedPage fetches a page of a query using Ne or In, whose cursor is
+// the position of the page in the merged results of the queries
+func (repository DefaultRepository) findMergedPage(query Query, cursor string, result interface{}) (string, error) {
+	start := 0
+	if cursor != "" {
+		var err error
+		if !strings.HasPrefix(cursor, mergedCursorPrefix) {
+			return "", ErrInvalidCursor
+		}
+		if start, err = strconv.Atoi(strings.TrimPrefix(cursor, mergedCursorPrefix)); err != nil || start < 0 {
+			return "", ErrInvalidCursor
+		}
+	}
+	paged := query
+	paged.Offset += start
 	if query.Limit > 0 {
-		q = q.Limit(query.Limit)
+		// the entity following the page tells if there is a next page
+		paged.Limit++
 	}
-	return q.Offset(query.Offset)
+	excludeDeleted, err := repository.excludesDeleted(result)
+	if err != nil {
+		return "", err
+	}
+	queries, err := repository.compile(paged, excludeDeleted)
+	if err != nil {
+		return "", err
+	}
+	keys, err := repository.getAll(queries, paged, result)
+	if err != nil {
+		return "", err
+	}
+	if dst, ok := result.(*[]*datastore.Key); ok && query.keysOnly {
+		*dst = keys
+	}
+	next := ""
+	if slice := reflect.ValueOf(result).Elem(); query.Limit > 0 && slice.Len() > query.Limit {
+		slice.SetLen(query.Limit)
+		next = mergedCursorPrefix + strconv.Itoa(start+query.Limit)
+	}
+	return next, repository.include(result)
+}
 
+// Count returns the object count given a query. Soft deleted entities are excluded
+// if SoftDelete is set or if New creates a SoftDeletableEntity, unless IncludeDeleted is set
+func (repository DefaultRepository) Count(
+	query Query) (int, error) {
+	excludeDeleted, err := repository.countExcludesDeleted()
+	if err != nil {
+		return 0, err
+	}
+	queries, err := repository.compile(query, excludeDeleted)
+	if err != nil {
+		return 0, err
+	}
+	if len(queries) == 1 {
+		return queries[0].Count(repository.Context)
+	}
+	results := []queryResult{}
+	for _, q := range queries {
+		keys, err := q.KeysOnly().GetAll(repository.Context, nil)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			results = append(results, queryResult{key: key})
+		}
+	}
+	return len(merge(results, nil, query.Offset, query.Limit)), nil
 }
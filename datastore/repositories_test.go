@@ -13,3 +13,376 @@
 //    limitations under the License.
 
 package datastore_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Mparaiso/appengine/datastore"
+	_ "github.com/Mparaiso/appengine/datastore/datastoretest"
+	"github.com/Mparaiso/go-tiger/test"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	appengine_datastore "google.golang.org/appengine/datastore"
+)
+
+type Article struct {
+	ID      int64
+	Title   string
+	Version int64
+}
+
+// GetID returns a int64
+func (article Article) GetID() int64 {
+	return article.ID
+}
+
+// SetID sets *Article.article
+func (article *Article) SetID(ID int64) {
+	article.ID = ID
+}
+
+// GetVersion returns a int64
+func (article Article) GetVersion() int64 {
+	return article.Version
+}
+
+// SetVersion sets *Article.article
+func (article *Article) SetVersion(Version int64) {
+	article.Version = Version
+}
+
+// Given a repository
+// When entities are created in a transaction
+// After* events should only be dispatched once the transaction is committed
+// When the transaction fails
+// No After* event should be dispatched
+func TestDefaultRepository_RunInTransaction(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	test.Fatal(t, err, nil)
+	defer done()
+	created := 0
+	repository := datastore.NewDefaultRepository(ctx, "articles", datastore.ListenerFunc(func(e datastore.Event) error {
+		if _, ok := e.(datastore.AfterEntityCreatedEvent); ok {
+			created++
+		}
+		return nil
+	}))
+	err = repository.RunInTransaction(func(tx datastore.Repository) error {
+		if err := tx.Create(&Article{Title: "First"}); err != nil {
+			return err
+		}
+		if err := tx.Create(&Article{Title: "Second"}); err != nil {
+			return err
+		}
+		test.Error(t, created, 0, "After* events should not be dispatched before commit")
+		return nil
+	}, &appengine_datastore.TransactionOptions{XG: true})
+	test.Fatal(t, err, nil)
+	test.Error(t, created, 2)
+
+	err = repository.RunInTransaction(func(tx datastore.Repository) error {
+		if err := tx.Create(&Article{Title: "Third"}); err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	}, nil)
+	test.Fatal(t, err != nil, true)
+	test.Error(t, created, 2, "After* events should not be dispatched on rollback")
+}
+
+// Given a versioned entity
+// When it is updated with the stored version
+// Its version should be incremented
+// When it is updated with a stale version
+// It should return an *ErrVersionConflict
+func TestDefaultRepository_Update_VersionConflict(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	test.Fatal(t, err, nil)
+	defer done()
+	repository := datastore.NewDefaultRepository(ctx, "articles")
+	article := &Article{Title: "Title"}
+	test.Fatal(t, repository.Create(article), nil)
+	test.Fatal(t, article.Version, int64(1))
+	test.Fatal(t, repository.Update(&Article{ID: article.ID, Title: "New title", Version: 1}), nil)
+
+	err = repository.Update(&Article{ID: article.ID, Title: "Stale title", Version: 1})
+	conflict, ok := err.(*datastore.ErrVersionConflict)
+	test.Fatal(t, ok, true, "error should be an *ErrVersionConflict")
+	test.Error(t, conflict.Expected, int64(2))
+	test.Error(t, conflict.Actual, int64(1))
+	test.Error(t, errors.Is(err, datastore.ErrVersionMismatch), true)
+}
+
+type Tag struct {
+	ID   int64
+	Name string
+}
+
+// GetID returns a int64
+func (tag Tag) GetID() int64 {
+	return tag.ID
+}
+
+// SetID sets *Tag.tag
+func (tag *Tag) SetID(ID int64) {
+	tag.ID = ID
+}
+
+// GetName returns a string
+func (tag Tag) GetName() string {
+	return tag.Name
+}
+
+// SetName sets *Tag.tag
+func (tag *Tag) SetName(Name string) {
+	tag.Name = Name
+}
+
+// Given a NamedEntity
+// When it is created
+// It should be found by name
+// When it is deleted
+// It should not be found
+func TestDefaultRepository_FindByName(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	test.Fatal(t, err, nil)
+	defer done()
+	repository := datastore.NewDefaultRepository(ctx, "tags")
+	test.Fatal(t, repository.Create(&Tag{}), datastore.ErrEmptyName)
+	test.Fatal(t, repository.Create(&Tag{Name: "golang"}), nil)
+	test.Fatal(t, repository.Key(&Tag{Name: "golang"}).StringID(), "golang")
+	tag := &Tag{}
+	test.Fatal(t, repository.FindByName("golang", tag), nil)
+	test.Error(t, tag.Name, "golang")
+	test.Error(t, tag.ID, int64(0))
+	test.Fatal(t, repository.Delete(tag), nil)
+	test.Fatal(t, repository.FindByName("golang", &Tag{}), datastore.ErrNoSuchEntity)
+}
+
+type Comment struct {
+	ID      int64
+	Body    string
+	Deleted time.Time
+}
+
+// GetID returns a int64
+func (comment Comment) GetID() int64 {
+	return comment.ID
+}
+
+// SetID sets *Comment.comment
+func (comment *Comment) SetID(ID int64) {
+	comment.ID = ID
+}
+
+// GetDeleted returns a time.Time
+func (comment Comment) GetDeleted() time.Time {
+	return comment.Deleted
+}
+
+// SetDeleted sets *Comment.comment
+func (comment *Comment) SetDeleted(Deleted time.Time) {
+	comment.Deleted = Deleted
+}
+
+// Reply is a soft deletable entity without a Deleted property
+type Reply struct {
+	ID        int64
+	DeletedAt time.Time
+}
+
+// GetID returns a int64
+func (reply Reply) GetID() int64 {
+	return reply.ID
+}
+
+// SetID sets *Reply.ID
+func (reply *Reply) SetID(ID int64) {
+	reply.ID = ID
+}
+
+// GetDeleted returns a time.Time
+func (reply Reply) GetDeleted() time.Time {
+	return reply.DeletedAt
+}
+
+// SetDeleted sets *Reply.DeletedAt
+func (reply *Reply) SetDeleted(DeletedAt time.Time) {
+	reply.DeletedAt = DeletedAt
+}
+
+// Given a SoftDeletableEntity
+// When it is deleted
+// It should only be found when deleted entities are included
+// When it is restored
+// It should be found
+// When it is purged
+// It should not be found at all
+func TestDefaultRepository_SoftDelete(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	test.Fatal(t, err, nil)
+	defer done()
+	restored := 0
+	repository := datastore.NewDefaultRepository(ctx, "comments", datastore.ListenerFunc(func(e datastore.Event) error {
+		if _, ok := e.(datastore.AfterEntityRestoredEvent); ok {
+			restored++
+		}
+		return nil
+	}))
+	comment := &Comment{Body: "Body"}
+	test.Fatal(t, repository.Create(comment), nil)
+	test.Fatal(t, repository.Delete(&Comment{ID: comment.ID}), nil)
+	test.Fatal(t, repository.FindByID(comment.ID, &Comment{}), datastore.ErrNoSuchEntity)
+
+	withDeleted := *repository
+	withDeleted.IncludeDeleted = true
+	deleted := &Comment{}
+	test.Fatal(t, withDeleted.FindByID(comment.ID, deleted), nil)
+	test.Error(t, deleted.Body, "Body", "soft delete should keep the stored fields")
+	test.Error(t, deleted.Deleted.IsZero(), false)
+
+	test.Fatal(t, repository.Restore(&Comment{ID: comment.ID}), nil)
+	test.Error(t, restored, 1)
+	test.Fatal(t, repository.FindByID(comment.ID, &Comment{}), nil)
+
+	test.Fatal(t, repository.Purge(comment), nil)
+	test.Fatal(t, withDeleted.FindByID(comment.ID, &Comment{}), datastore.ErrNoSuchEntity)
+	test.Fatal(t, repository.Restore(&Tag{Name: "golang"}), datastore.ErrNotSoftDeletable)
+}
+
+// Given multiple entities
+// When they are fetched, updated and deleted in batch
+// Errors should be reported in an appengine.MultiError indexed like the entities
+func TestDefaultRepository_BatchOperations(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	test.Fatal(t, err, nil)
+	defer done()
+	updated := 0
+	repository := datastore.NewDefaultRepository(ctx, "articles", datastore.ListenerFunc(func(e datastore.Event) error {
+		if _, ok := e.(datastore.AfterEntityUpdatedEvent); ok {
+			updated++
+		}
+		return nil
+	}))
+	first, second := &Article{Title: "First"}, &Article{Title: "Second"}
+	test.Fatal(t, repository.CreateMulti(first, second), nil)
+
+	articles := []*Article{}
+	err = repository.FindByIDs([]int64{first.ID, second.ID + 1000, second.ID}, &articles)
+	errs, ok := err.(appengine.MultiError)
+	test.Fatal(t, ok, true, "error should be an appengine.MultiError")
+	test.Error(t, errs[0], nil)
+	test.Error(t, errs[1], datastore.ErrNoSuchEntity)
+	test.Error(t, errs[2], nil)
+	test.Error(t, articles[2].Title, "Second")
+
+	first.Title, second.Title = "First updated", "Second updated"
+	test.Fatal(t, repository.UpdateMulti(first, second), nil)
+	test.Error(t, updated, 2)
+	test.Error(t, first.Version, int64(2))
+
+	err = repository.UpdateMulti(&Article{ID: first.ID, Version: 1}, second)
+	errs, ok = err.(appengine.MultiError)
+	test.Fatal(t, ok, true, "error should be an appengine.MultiError")
+	_, ok = errs[0].(*datastore.ErrVersionConflict)
+	test.Error(t, ok, true)
+	test.Error(t, errs[1], nil)
+
+	test.Fatal(t, repository.DeleteMulti(first, second), nil)
+	test.Fatal(t, repository.FindByIDs([]int64{first.ID, second.ID}, &articles) != nil, true)
+}
+
+type Document struct {
+	ID     int64
+	Body   string
+	Locked bool
+}
+
+// GetID returns a int64
+func (document Document) GetID() int64 {
+	return document.ID
+}
+
+// SetID sets *Document.ID
+func (document *Document) SetID(ID int64) {
+	document.ID = ID
+}
+
+// IsLocked returns true if the document is locked
+func (document Document) IsLocked() bool {
+	return document.Locked
+}
+
+// Given a locked entity
+// When it is updated or deleted, even with a copy that is not locked
+// It should return ErrEntityLocked
+func TestDefaultRepository_LockedEntity(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	test.Fatal(t, err, nil)
+	defer done()
+	repository := datastore.NewDefaultRepository(ctx, "documents")
+	document := &Document{Body: "Body", Locked: true}
+	test.Fatal(t, repository.Create(document), nil)
+
+	err = repository.Update(&Document{ID: document.ID, Body: "New body"})
+	test.Error(t, errors.Is(err, datastore.ErrEntityLocked), true)
+	err = repository.Delete(&Document{ID: document.ID})
+	test.Error(t, errors.Is(err, datastore.ErrEntityLocked), true)
+
+	unlocked := &Document{Body: "Body"}
+	test.Fatal(t, repository.Create(unlocked), nil)
+	err = repository.DeleteMulti(&Document{ID: unlocked.ID}, &Document{ID: document.ID})
+	errs, ok := err.(appengine.MultiError)
+	test.Fatal(t, ok, true, "error should be an appengine.MultiError")
+	test.Error(t, errs[0], nil)
+	test.Error(t, errs[1], datastore.ErrEntityLocked)
+	test.Fatal(t, repository.FindByID(unlocked.ID, &Document{}), nil, "nothing should be deleted if a listener fails")
+}
+
+// Given an ErrVersionConflict
+// errors.Is should match ErrVersionMismatch
+func TestErrVersionConflict(t *testing.T) {
+	var err error = fmt.Errorf("update failed: %w", &datastore.ErrVersionConflict{Expected: 2, Actual: 1})
+	test.Error(t, errors.Is(err, datastore.ErrVersionMismatch), true)
+	conflict := &datastore.ErrVersionConflict{}
+	test.Fatal(t, errors.As(err, &conflict), true)
+	test.Error(t, conflict.Expected, int64(2))
+}
+
+// Given a TypedRepository
+// When entities are created, fetched, listed and updated
+// It should return typed entities
+// It should dispatch events to the signal of the wrapped repository
+func TestTypedRepository(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	test.Fatal(t, err, nil)
+	defer done()
+	created := 0
+	repository := datastore.NewTypedRepository(datastore.NewDefaultRepository(ctx, "articles", datastore.ListenerFunc(func(e datastore.Event) error {
+		if _, ok := e.(datastore.AfterEntityCreatedEvent); ok {
+			created++
+		}
+		return nil
+	})), func() *Article { return &Article{} })
+	article := &Article{Title: "Title"}
+	test.Fatal(t, repository.Create(article), nil)
+	test.Error(t, created, 1)
+
+	found, err := repository.Get(article.ID)
+	test.Fatal(t, err, nil)
+	test.Error(t, found.Title, "Title")
+	_, err = repository.Get(article.ID + 1000)
+	test.Error(t, err, datastore.ErrNoSuchEntity)
+
+	found.Title = "New title"
+	test.Fatal(t, repository.Update(found), nil)
+	test.Error(t, found.Version, int64(2))
+
+	articles, err := repository.List(datastore.Query{}.Where("Title", datastore.Eq, "New title"))
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(articles), 1)
+	test.Error(t, articles[0].ID, article.ID)
+}
@@ -14,8 +14,20 @@
 
 package datastore
 
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
 type Event interface{}
 
+// ErrStopPropagation is returned by a listener to stop the dispatch of an event
+// to the following listeners, Dispatch then returns nil
+var ErrStopPropagation = fmt.Errorf("ErrStopPropagation")
+
 // Signal is an implementation of the signal pattern
 type Signal interface {
 	Add(Listener)
@@ -23,11 +35,24 @@ type Signal interface {
 	Dispatch(data Event) error
 }
 
+// SubscriptionSignal is a Signal whose listeners can subscribe to a type of event with a priority
+type SubscriptionSignal interface {
+	Signal
+	AddFor(eventType Event, listener Listener, priority int)
+}
+
 // Listener handle signals
 type Listener interface {
 	Handle(data Event) error
 }
 
+// NamedListener is a Listener identified by its name rather than by its value,
+// a signal removes the listener with the same name
+type NamedListener interface {
+	Listener
+	GetName() string
+}
+
 type funcListener struct {
 	Listener func(data Event) error
 }
@@ -40,48 +65,143 @@ func ListenerFunc(f func(data Event) error) *funcListener {
 	return &funcListener{f}
 }
 
+type namedFuncListener struct {
+	funcListener
+	name string
+}
+
+func (listener namedFuncListener) GetName() string {
+	return listener.name
+}
+
+// NamedListenerFunc returns a NamedListener calling f,
+// NamedListenerFunc(name, nil) can be used to remove it
+func NamedListenerFunc(name string, f func(data Event) error) NamedListener {
+	return namedFuncListener{funcListener{f}, name}
+}
+
+// sameListener returns true if a and b are the same listener
+func sameListener(a, b Listener) bool {
+	if named, ok := a.(NamedListener); ok {
+		if other, ok := b.(NamedListener); ok {
+			return named.GetName() == other.GetName()
+		}
+		return false
+	}
+	if _, ok := b.(NamedListener); ok {
+		return false
+	}
+	return a == b
+}
+
+type subscription struct {
+	listener  Listener
+	eventType reflect.Type
+	priority  int
+}
+
+// DefaultSignal is safe for concurrent use. Subscriptions are copied on write
+// so that Dispatch runs listeners without holding a lock, listeners can therefore
+// add or remove listeners, which apply to the next dispatched events.
+//
+// The listeners are no longer exported as a Listeners field, which could not be read
+// or written safely while events are dispatched : Listeners returns a copy of them,
+// Add, AddFor and Remove change them.
 type DefaultSignal struct {
-	Listeners []Listener
+	mutex         sync.RWMutex
+	subscriptions []subscription
 }
 
 func NewDefaultSignal() *DefaultSignal {
-	return &DefaultSignal{Listeners: []Listener{}}
+	return &DefaultSignal{subscriptions: []subscription{}}
 }
 
+// Add adds a listener called with every event, with the priority 0
 func (signal *DefaultSignal) Add(l Listener) {
-	if signal.IndexOf(l) != -1 {
-		return
+	signal.AddFor(nil, l, 0)
+}
+
+// AddFor adds a listener called with the events of the type of eventType only,
+// such as AfterEntityCreatedEvent{}, or with every event if eventType is nil.
+// Listeners with a higher priority are called first, listeners with the same priority
+// are called in the order they were added. Adding a listener already subscribed
+// to the same type of event is a no-op.
+func (signal *DefaultSignal) AddFor(eventType Event, l Listener, priority int) {
+	var t reflect.Type
+	if eventType != nil {
+		t = reflect.TypeOf(eventType)
+	}
+	signal.mutex.Lock()
+	defer signal.mutex.Unlock()
+	for _, subscription := range signal.subscriptions {
+		if subscription.eventType == t && sameListener(subscription.listener, l) {
+			return
+		}
 	}
-	signal.Listeners = append(signal.Listeners, l)
+	subscriptions := make([]subscription, len(signal.subscriptions), len(signal.subscriptions)+1)
+	copy(subscriptions, signal.subscriptions)
+	subscriptions = append(subscriptions, subscription{listener: l, eventType: t, priority: priority})
+	sort.SliceStable(subscriptions, func(i, j int) bool {
+		return subscriptions[i].priority > subscriptions[j].priority
+	})
+	signal.subscriptions = subscriptions
 }
 
+// IndexOf returns the index of the first subscription of a listener, or -1
 func (signal *DefaultSignal) IndexOf(l Listener) int {
-	for i, listener := range signal.Listeners {
-		if listener == l {
+	for i, subscription := range signal.snapshot() {
+		if sameListener(subscription.listener, l) {
 			return i
 		}
 	}
 	return -1
 }
 
-func (signal *DefaultSignal) Remove(l Listener) {
-	index := signal.IndexOf(l)
-	if index == -1 {
-		return
+// Listeners returns a copy of the subscribed listeners in order of priority,
+// a listener subscribed to several event types is returned once per subscription
+func (signal *DefaultSignal) Listeners() []Listener {
+	subscriptions := signal.snapshot()
+	listeners := make([]Listener, len(subscriptions))
+	for i, subscription := range subscriptions {
+		listeners[i] = subscription.listener
 	}
-	head := signal.Listeners[:index]
-	if index == len(signal.Listeners)-1 {
-		signal.Listeners = head
-	} else {
-		signal.Listeners = append(head, signal.Listeners[index+1:]...)
+	return listeners
+}
+
+// Remove removes every subscription of a listener
+func (signal *DefaultSignal) Remove(l Listener) {
+	signal.mutex.Lock()
+	defer signal.mutex.Unlock()
+	subscriptions := []subscription{}
+	for _, subscription := range signal.subscriptions {
+		if !sameListener(subscription.listener, l) {
+			subscriptions = append(subscriptions, subscription)
+		}
 	}
+	signal.subscriptions = subscriptions
 }
 
+// Dispatch calls the listeners subscribed to the event in order of priority,
+// until a listener returns an error. ErrStopPropagation stops the dispatch without error
 func (signal *DefaultSignal) Dispatch(data Event) error {
-	for _, listener := range signal.Listeners {
-		if err := listener.Handle(data); err != nil {
+	t := reflect.TypeOf(data)
+	for _, subscription := range signal.snapshot() {
+		if subscription.eventType != nil && subscription.eventType != t {
+			continue
+		}
+		if err := subscription.listener.Handle(data); err != nil {
+			if errors.Is(err, ErrStopPropagation) {
+				return nil
+			}
 			return err
 		}
 	}
 	return nil
 }
+
+// snapshot returns the current subscriptions, which are never modified
+func (signal *DefaultSignal) snapshot() []subscription {
+	signal.mutex.RLock()
+	defer signal.mutex.RUnlock()
+	return signal.subscriptions
+}
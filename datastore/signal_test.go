@@ -16,8 +16,12 @@ package datastore_test
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"testing"
 
 	signal "github.com/Mparaiso/appengine/datastore"
+	"github.com/Mparaiso/go-tiger/test"
 )
 
 func ExampleSignal() {
@@ -39,3 +43,74 @@ func ExampleSignal() {
 	// Output:
 	// Hello from signal
 }
+
+// Given listeners subscribed with priorities and event types
+// When an event is dispatched
+// It should call the listeners subscribed to its type by priority
+// When a listener returns ErrStopPropagation
+// It should not call the following listeners
+func TestDefaultSignal_AddFor(t *testing.T) {
+	type DummyEvent struct{}
+	type OtherEvent struct{}
+	calls := []string{}
+	listener := func(name string, err error) signal.Listener {
+		return signal.NamedListenerFunc(name, func(e signal.Event) error {
+			calls = append(calls, name)
+			return err
+		})
+	}
+	s := signal.NewDefaultSignal()
+	s.Add(listener("any", nil))
+	s.AddFor(DummyEvent{}, listener("low", nil), -10)
+	s.AddFor(DummyEvent{}, listener("high", nil), 10)
+	s.AddFor(OtherEvent{}, listener("other", nil), 20)
+	s.AddFor(DummyEvent{}, listener("default", nil), 0)
+	test.Fatal(t, s.Dispatch(DummyEvent{}), nil)
+	test.Error(t, strings.Join(calls, ","), "high,any,default,low")
+
+	calls = []string{}
+	s.AddFor(DummyEvent{}, listener("stop", signal.ErrStopPropagation), 5)
+	test.Fatal(t, s.Dispatch(DummyEvent{}), nil)
+	test.Error(t, strings.Join(calls, ","), "high,stop")
+
+	calls = []string{}
+	s.Remove(signal.NamedListenerFunc("stop", nil))
+	s.Remove(signal.NamedListenerFunc("high", nil))
+	test.Fatal(t, s.Dispatch(DummyEvent{}), nil)
+	test.Error(t, strings.Join(calls, ","), "any,default,low")
+	test.Error(t, s.IndexOf(signal.NamedListenerFunc("high", nil)), -1)
+	listeners := s.Listeners()
+	test.Fatal(t, len(listeners), 4)
+	test.Error(t, s.IndexOf(listeners[0]), 0, "listeners should be returned in order of priority")
+}
+
+// Given a signal shared by goroutines
+// When listeners are added, removed and dispatched concurrently
+// It should not race, run with go test -race
+func TestDefaultSignal_Concurrency(t *testing.T) {
+	type DummyEvent struct{}
+	s := signal.NewDefaultSignal()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		name := fmt.Sprintf("listener-%d", i)
+		go func() {
+			defer wg.Done()
+			s.AddFor(DummyEvent{}, signal.NamedListenerFunc(name, func(e signal.Event) error {
+				// listeners can modify the signal while it is dispatching
+				s.Add(signal.NamedListenerFunc(name+"-nested", func(signal.Event) error { return nil }))
+				return nil
+			}), i%3)
+		}()
+		go func() {
+			defer wg.Done()
+			s.Remove(signal.NamedListenerFunc(name, nil))
+		}()
+		go func() {
+			defer wg.Done()
+			test.Error(t, s.Dispatch(DummyEvent{}), nil)
+		}()
+	}
+	wg.Wait()
+	test.Error(t, s.Dispatch(DummyEvent{}), nil)
+}
@@ -0,0 +1,94 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package datastore
+
+// TypedRepository is a type safe repository of entities of type T, such as *Article.
+// It wraps a Repository, such as a DefaultRepository, so listeners of the Signal of the wrapped
+// repository receive its events and the untyped methods such as FindBy or Count remain available.
+type TypedRepository[T Entity] struct {
+	Repository
+	new func() T
+}
+
+// NewTypedRepository creates a TypedRepository wrapping repository,
+// newEntity creates new entities of type T and becomes the factory of repository
+// if it is an EntityFactorySetter
+func NewTypedRepository[T Entity](repository Repository, newEntity func() T) *TypedRepository[T] {
+	if setter, ok := repository.(EntityFactorySetter); ok {
+		setter.SetNew(func() Entity { return newEntity() })
+	}
+	return &TypedRepository[T]{Repository: repository, new: newEntity}
+}
+
+// Get fetches an entity by ID
+func (repository TypedRepository[T]) Get(id int64) (T, error) {
+	entity := repository.new()
+	if err := repository.Repository.FindByID(id, entity); err != nil {
+		var zero T
+		return zero, err
+	}
+	return entity, nil
+}
+
+// GetByName fetches a NamedEntity by name
+func (repository TypedRepository[T]) GetByName(name string) (T, error) {
+	entity := repository.new()
+	if err := repository.Repository.FindByName(name, entity); err != nil {
+		var zero T
+		return zero, err
+	}
+	return entity, nil
+}
+
+// GetMulti fetches entities by IDs, errors are reported like FindByIDs
+func (repository TypedRepository[T]) GetMulti(ids []int64) ([]T, error) {
+	entities := []T{}
+	err := repository.Repository.FindByIDs(ids, &entities)
+	return entities, err
+}
+
+// List fetches the entities matching a query, keys only queries must use FindBy
+func (repository TypedRepository[T]) List(query Query) ([]T, error) {
+	entities := []T{}
+	if err := repository.Repository.FindBy(query, &entities); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// Page fetches a page of entities, see FindPage
+func (repository TypedRepository[T]) Page(query Query, cursor string) ([]T, string, error) {
+	entities := []T{}
+	next, err := repository.Repository.FindPage(query, cursor, &entities)
+	if err != nil {
+		return nil, "", err
+	}
+	return entities, next, nil
+}
+
+// Create creates an entity
+func (repository TypedRepository[T]) Create(entity T) error {
+	return repository.Repository.Create(entity)
+}
+
+// Update updates an entity
+func (repository TypedRepository[T]) Update(entity T) error {
+	return repository.Repository.Update(entity)
+}
+
+// Delete deletes an entity
+func (repository TypedRepository[T]) Delete(entity T) error {
+	return repository.Repository.Delete(entity)
+}
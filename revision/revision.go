@@ -0,0 +1,257 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package revision keeps the previous versions of updated entities.
+//
+// A History listens to the BeforeEntityUpdated events of a repository signal
+// and stores a snapshot of each replaced version of a VersionedEntity,
+// as a child of the updated entity. Versioned entities are updated in a transaction,
+// so a snapshot is only kept when the update succeeds :
+//
+//	history := revision.NewHistory()
+//	repository.Signal.Add(history)
+//	// later
+//	revisions, err := history.List(ctx, repository.Key(article))
+//	err = history.Rollback(ctx, repository, article, revisions[0].Version)
+package revision
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/Mparaiso/appengine/audit"
+	"github.com/Mparaiso/appengine/datastore"
+	"golang.org/x/net/context"
+	appengine_datastore "google.golang.org/appengine/datastore"
+)
+
+// Kind is the datastore kind of revisions
+const Kind = "revision"
+
+var (
+	ErrNoSuchRevision = fmt.Errorf("ErrNoSuchRevision")
+	ErrNotVersioned   = fmt.Errorf("This value doesn't implement VersionedEntity interface")
+)
+
+// Revision is a snapshot of a version of an entity, stored as a child of the key of the entity
+type Revision struct {
+	ID int64
+	// Entity is the key of the entity
+	Entity  *appengine_datastore.Key
+	Version int64
+	// Snapshot holds the gob encoded datastore properties of the entity
+	Snapshot []byte
+	// Replaced is the time the version was replaced by an update
+	Replaced time.Time
+}
+
+// GetID returns a int64
+func (revision Revision) GetID() int64 {
+	return revision.ID
+}
+
+// SetID sets *Revision.ID
+func (revision *Revision) SetID(ID int64) {
+	revision.ID = ID
+}
+
+// NewRevision returns a revision of the current version of entity, stored at key
+func NewRevision(key *appengine_datastore.Key, entity datastore.Entity) (*Revision, error) {
+	snapshot, err := datastore.EncodeProperties(entity)
+	if err != nil {
+		return nil, err
+	}
+	revision := &Revision{Entity: key, Snapshot: snapshot, Replaced: time.Now()}
+	if versioned, ok := entity.(datastore.VersionedEntity); ok {
+		revision.Version = versioned.GetVersion()
+	}
+	return revision, nil
+}
+
+// Properties returns the datastore properties of the snapshot
+func (revision Revision) Properties() ([]appengine_datastore.Property, error) {
+	return datastore.DecodeProperties(revision.Snapshot)
+}
+
+// Load loads the snapshot into entity
+func (revision Revision) Load(entity datastore.Entity) error {
+	return datastore.LoadProperties(revision.Snapshot, entity)
+}
+
+// Diff returns the changes of the datastore properties between the snapshots of old and new,
+// multiple values of a property are compared as a list
+func Diff(old, new *Revision) ([]audit.Change, error) {
+	oldProperties, err := old.Properties()
+	if err != nil {
+		return nil, err
+	}
+	newProperties, err := new.Properties()
+	if err != nil {
+		return nil, err
+	}
+	return audit.Diff(values(oldProperties), values(newProperties))
+}
+
+// values returns the values of properties by name
+func values(properties []appengine_datastore.Property) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, property := range properties {
+		if !property.Multiple {
+			result[property.Name] = property.Value
+			continue
+		}
+		list, _ := result[property.Name].([]interface{})
+		result[property.Name] = append(list, property.Value)
+	}
+	return result
+}
+
+// History is a datastore.Listener keeping the replaced versions of versioned entities
+type History struct {
+	// NewRepository creates the repositories of the revisions,
+	// datastore.NewDefaultRepository is used if nil
+	NewRepository func(ctx context.Context, kind string) datastore.Repository
+}
+
+// NewHistory creates a History
+func NewHistory() *History {
+	return &History{}
+}
+
+// repository returns a repository of the revisions of the entity of key
+func (history History) repository(ctx context.Context, key *appengine_datastore.Key) (datastore.Repository, error) {
+	var repository datastore.Repository
+	if history.NewRepository != nil {
+		repository = history.NewRepository(ctx, Kind)
+	} else {
+		repository = datastore.NewDefaultRepository(ctx, Kind)
+	}
+	setter, ok := repository.(datastore.ParentKeySetter)
+	if !ok {
+		return nil, fmt.Errorf("The repository of the revisions must be a datastore.ParentKeySetter")
+	}
+	setter.SetParentKey(key)
+	return repository, nil
+}
+
+// Handle stores a revision of the stored version of the entity of a BeforeEntityUpdatedEvent,
+// with the context of the event so that it joins the transaction of the update.
+// Other events and entities that are not versioned are ignored.
+func (history History) Handle(e datastore.Event) error {
+	event, ok := e.(datastore.BeforeEntityUpdatedEvent)
+	if !ok || event.Key == nil || event.Key.Kind() == Kind {
+		return nil
+	}
+	if _, ok := event.Old.(datastore.VersionedEntity); !ok {
+		return nil
+	}
+	revision, err := NewRevision(event.Key, event.Old)
+	if err != nil {
+		return err
+	}
+	repository, err := history.repository(event.Context, event.Key)
+	if err != nil {
+		return err
+	}
+	return repository.Create(revision)
+}
+
+// List returns the revisions of the entity of key, oldest first
+func (history History) List(ctx context.Context, key *appengine_datastore.Key) ([]*Revision, error) {
+	repository, err := history.repository(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	revisions := []*Revision{}
+	// revisions of the descendants of the entity are filtered out, the revisions are sorted
+	// once loaded since sorting an ancestor query with a filter needs a composite index
+	query := datastore.Where("Entity", datastore.Eq, key)
+	if err = repository.FindBy(query, &revisions); err != nil {
+		return nil, err
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Version < revisions[j].Version
+	})
+	return revisions, nil
+}
+
+// Get returns the revision of a version of the entity of key
+func (history History) Get(ctx context.Context, key *appengine_datastore.Key, version int64) (*Revision, error) {
+	repository, err := history.repository(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	revisions := []*Revision{}
+	query := datastore.Where("Entity", datastore.Eq, key).And("Version", datastore.Eq, version)
+	query.Limit = 1
+	if err = repository.FindBy(query, &revisions); err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, ErrNoSuchRevision
+	}
+	return revisions[0], nil
+}
+
+// AsOf returns the revision of the version of the entity of key that was current at date.
+// ErrNoSuchRevision is returned if the entity has not been updated since date,
+// the stored entity is then the entity as of date. The first revision is returned
+// for a date preceding the creation of the entity.
+func (history History) AsOf(ctx context.Context, key *appengine_datastore.Key, date time.Time) (*Revision, error) {
+	revisions, err := history.List(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, revision := range revisions {
+		if revision.Replaced.After(date) {
+			return revision, nil
+		}
+	}
+	return nil, ErrNoSuchRevision
+}
+
+// Rollback updates entity with the snapshot of a previous version through repository.Update,
+// so listeners are called and the replaced version is kept as a new revision.
+// entity is the current version of the entity, the update fails with a datastore.ErrVersionConflict
+// if it is outdated. repository must be a datastore.Keyer, entity is left unchanged on error.
+func (history History) Rollback(ctx context.Context, repository datastore.Repository, entity datastore.Entity, version int64) error {
+	current, ok := entity.(datastore.VersionedEntity)
+	if !ok {
+		return ErrNotVersioned
+	}
+	keyer, ok := repository.(datastore.Keyer)
+	if !ok {
+		return fmt.Errorf("The repository of a rolled back entity must be a datastore.Keyer")
+	}
+	revision, err := history.Get(ctx, keyer.Key(entity), version)
+	if err != nil {
+		return err
+	}
+	rolledBack := reflect.New(reflect.Indirect(reflect.ValueOf(entity)).Type()).Interface().(datastore.Entity)
+	if err = revision.Load(rolledBack); err != nil {
+		return err
+	}
+	rolledBack.SetID(entity.GetID())
+	if named, ok := entity.(datastore.NamedEntity); ok {
+		rolledBack.(datastore.NamedEntity).SetName(named.GetName())
+	}
+	rolledBack.(datastore.VersionedEntity).SetVersion(current.GetVersion())
+	if err = repository.Update(rolledBack); err != nil {
+		return err
+	}
+	reflect.ValueOf(entity).Elem().Set(reflect.ValueOf(rolledBack).Elem())
+	return nil
+}
@@ -0,0 +1,197 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package revision_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mparaiso/appengine/audit"
+	"github.com/Mparaiso/appengine/datastore"
+	_ "github.com/Mparaiso/appengine/datastore/datastoretest"
+	"github.com/Mparaiso/appengine/revision"
+	"github.com/Mparaiso/go-tiger/test"
+	"golang.org/x/net/context"
+)
+
+type Page struct {
+	ID      int64
+	Title   string
+	Tags    []string
+	Version int64
+	Parent  datastore.Ref[*Page]
+}
+
+// GetID returns a int64
+func (page Page) GetID() int64 {
+	return page.ID
+}
+
+// SetID sets *Page.ID
+func (page *Page) SetID(ID int64) {
+	page.ID = ID
+}
+
+// GetVersion returns a int64
+func (page Page) GetVersion() int64 {
+	return page.Version
+}
+
+// SetVersion sets *Page.Version
+func (page *Page) SetVersion(Version int64) {
+	page.Version = Version
+}
+
+// newRepository returns a repository of pages whose revisions are kept in the same store
+func newRepository(ctx context.Context) (*datastore.InMemoryRepository, *revision.History) {
+	store := datastore.NewMemoryStore()
+	history := revision.NewHistory()
+	history.NewRepository = func(ctx context.Context, kind string) datastore.Repository {
+		repository := datastore.NewInMemoryRepository(ctx, kind)
+		repository.Store = store
+		return repository
+	}
+	repository := datastore.NewInMemoryRepository(ctx, "pages", history)
+	repository.Store = store
+	return repository, history
+}
+
+func versions(revisions []*revision.Revision) []int64 {
+	result := []int64{}
+	for _, revision := range revisions {
+		result = append(result, revision.Version)
+	}
+	return result
+}
+
+// Given a versioned page updated twice
+// Its revisions should hold the replaced versions
+// When an update fails
+// No revision should be kept
+// When the page is rolled back
+// It should be updated with the content of the revision
+// And the replaced version should be kept
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	repository, history := newRepository(ctx)
+	page := &Page{Title: "First", Tags: []string{"a"}}
+	test.Fatal(t, repository.Create(page), nil)
+	before := time.Now()
+	page.Title = "Second"
+	test.Fatal(t, repository.Update(page), nil)
+	page.Title = "Third"
+	page.Tags = []string{"a", "b"}
+	test.Fatal(t, repository.Update(page), nil)
+	key := repository.Key(page)
+
+	revisions, err := history.List(ctx, key)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, versions(revisions), []int64{1, 2})
+	first := &Page{}
+	test.Fatal(t, revisions[0].Load(first), nil)
+	test.Error(t, first.Title, "First")
+	test.Error(t, first.Version, int64(1))
+
+	err = repository.Update(&Page{ID: page.ID, Title: "Stale", Version: 1})
+	test.Error(t, errors.Is(err, datastore.ErrVersionMismatch), true)
+	revisions, err = history.List(ctx, key)
+	test.Fatal(t, err, nil)
+	test.Error(t, len(revisions), 2, "a failed update should not keep a revision")
+
+	asOf, err := history.AsOf(ctx, key, before)
+	test.Fatal(t, err, nil)
+	test.Error(t, asOf.Version, int64(1))
+	_, err = history.AsOf(ctx, key, time.Now())
+	test.Error(t, err, revision.ErrNoSuchRevision)
+	_, err = history.Get(ctx, key, 5)
+	test.Error(t, err, revision.ErrNoSuchRevision)
+
+	test.Fatal(t, history.Rollback(ctx, repository, page, 1), nil)
+	test.Error(t, page.Title, "First")
+	test.Error(t, strings.Join(page.Tags, ","), "a")
+	test.Error(t, page.Version, int64(4))
+	found := &Page{}
+	test.Fatal(t, repository.FindByID(page.ID, found), nil)
+	test.Error(t, found.Title, "First")
+	revisions, err = history.List(ctx, key)
+	test.Fatal(t, err, nil)
+	test.Error(t, versions(revisions), []int64{1, 2, 3})
+
+	err = history.Rollback(ctx, repository, &Page{ID: page.ID, Version: 2}, 1)
+	test.Error(t, errors.Is(err, datastore.ErrVersionMismatch), true)
+}
+
+// Given a page referencing no parent page
+// When it is updated
+// Its revision should be kept with a nil parent key
+// When it is rolled back after its parent is set
+// Its parent should be nil
+func TestHistory_NilKey(t *testing.T) {
+	ctx := context.Background()
+	repository, history := newRepository(ctx)
+	page := &Page{Title: "Child"}
+	test.Fatal(t, repository.Create(page), nil)
+	parent := &Page{Title: "Parent"}
+	test.Fatal(t, repository.Create(parent), nil)
+	page.Parent = datastore.NewRef[*Page](repository.Key(parent))
+	test.Fatal(t, repository.Update(page), nil)
+
+	revisions, err := history.List(ctx, repository.Key(page))
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(revisions), 1)
+	test.Fatal(t, history.Rollback(ctx, repository, page, 1), nil)
+	test.Error(t, page.Parent.Key == nil, true)
+	test.Error(t, page.Title, "Child")
+}
+
+// Given revisions stored out of order
+// When they are listed
+// They should be sorted by version
+func TestHistory_List_Order(t *testing.T) {
+	ctx := context.Background()
+	repository, history := newRepository(ctx)
+	page := &Page{Title: "Page"}
+	test.Fatal(t, repository.Create(page), nil)
+	key := repository.Key(page)
+	revisions := datastore.NewInMemoryRepository(ctx, revision.Kind)
+	revisions.Store = repository.Store
+	revisions.SetParentKey(key)
+	test.Fatal(t, revisions.CreateMulti(&revision.Revision{Entity: key, Version: 2}, &revision.Revision{Entity: key, Version: 1}), nil)
+
+	listed, err := history.List(ctx, key)
+	test.Fatal(t, err, nil)
+	test.Error(t, versions(listed), []int64{1, 2})
+}
+
+// Given two revisions of a page
+// When they are compared
+// It should return the changed properties
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	repository, _ := newRepository(ctx)
+	key := repository.Key(&Page{ID: 1})
+	old, err := revision.NewRevision(key, &Page{ID: 1, Title: "Title", Tags: []string{"a"}, Version: 1})
+	test.Fatal(t, err, nil)
+	new, err := revision.NewRevision(key, &Page{ID: 1, Title: "Title", Tags: []string{"a", "b"}, Version: 2})
+	test.Fatal(t, err, nil)
+
+	changes, err := revision.Diff(old, new)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(changes), 2)
+	test.Error(t, changes[0], audit.Change{Field: "Tags", Old: `["a"]`, New: `["a","b"]`})
+	test.Error(t, changes[1], audit.Change{Field: "Version", Old: `1`, New: `2`})
+}
@@ -0,0 +1,76 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var ErrNotAStructPointer = fmt.Errorf("ErrNotAStructPointer")
+
+// Mapper maps a value onto a destination value.
+// A CreatePrototype or an UpdatePrototype implementing Mapper maps itself onto the entity,
+// an entity implementing Mapper maps itself onto the OutputPrototype.
+// Values that do not implement Mapper are mapped with CopyFields
+type Mapper interface {
+	Map(destination interface{}) error
+}
+
+// CopyFields copies the exported fields of source to the fields of destination
+// with the same name and an assignable type, other fields of destination are left unchanged.
+// destination must be a pointer to a struct
+func CopyFields(destination, source interface{}) error {
+	to := reflect.ValueOf(destination)
+	if to.Kind() != reflect.Ptr || to.Elem().Kind() != reflect.Struct {
+		return ErrNotAStructPointer
+	}
+	from := reflect.Indirect(reflect.ValueOf(source))
+	if from.Kind() != reflect.Struct {
+		return ErrNotAStructPointer
+	}
+	copyFields(to.Elem(), from)
+	return nil
+}
+
+func copyFields(to, from reflect.Value) {
+	for i := 0; i < from.NumField(); i++ {
+		field := from.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			copyFields(to, from.Field(i))
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		target := to.FieldByName(field.Name)
+		if target.IsValid() && target.CanSet() && field.Type.AssignableTo(target.Type()) {
+			target.Set(from.Field(i))
+		}
+	}
+}
+
+// mapValue maps source onto destination
+func mapValue(destination, source interface{}) error {
+	if mapper, ok := source.(Mapper); ok {
+		return mapper.Map(destination)
+	}
+	return CopyFields(destination, source)
+}
+
+// newValue returns a pointer to a new zero value of the type of prototype
+func newValue(prototype interface{}) interface{} {
+	return reflect.New(reflect.Indirect(reflect.ValueOf(prototype)).Type()).Interface()
+}
@@ -0,0 +1,70 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/Mparaiso/appengine/utils"
+	"github.com/Mparaiso/go-tiger/test"
+)
+
+type TestUserInput struct {
+	Username, Email, PlainPassword string
+}
+
+type TestUserOutput struct {
+	ID       int64
+	Username string
+	Email    string
+}
+
+type Timestamps struct {
+	Created int64
+}
+
+type TestPost struct {
+	Timestamps
+	Title string
+	Tags  []string
+	ID    string
+}
+
+// Given a destination and a source
+// When CopyFields is called
+// It should copy the fields with the same name and an assignable type
+// It should leave the other fields of destination unchanged
+func TestCopyFields(t *testing.T) {
+	user := &TestUser{ID: 1, EncryptedPassword: "hash", Username: "johndoe"}
+	err := utils.CopyFields(user, TestUserInput{Username: "janedoe", Email: "janedoe@example.com"})
+	test.Fatal(t, err, nil)
+	test.Error(t, *user, TestUser{ID: 1, EncryptedPassword: "hash", Username: "janedoe", Email: "janedoe@example.com"})
+
+	post := &TestPost{ID: "unchanged"}
+	err = utils.CopyFields(post, struct {
+		Timestamps
+		Title string
+		Tags  []string
+		ID    int64
+	}{Timestamps{10}, "title", []string{"go"}, 2})
+	test.Fatal(t, err, nil)
+	test.Error(t, post.Created, int64(10), "embedded fields should be copied")
+	test.Error(t, post.Title, "title")
+	test.Error(t, len(post.Tags), 1)
+	test.Error(t, post.ID, "unchanged", "fields with a different type should not be copied")
+
+	test.Error(t, utils.CopyFields(TestUser{}, TestUserInput{}), utils.ErrNotAStructPointer)
+	test.Error(t, utils.CopyFields(&TestUser{}, "string"), utils.ErrNotAStructPointer)
+}
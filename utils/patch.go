@@ -0,0 +1,323 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MergePatchContentType is the content type of a RFC 7396 JSON Merge Patch
+	MergePatchContentType = "application/merge-patch+json"
+	// JSONPatchContentType is the content type of a RFC 6902 JSON Patch
+	JSONPatchContentType = "application/json-patch+json"
+)
+
+var (
+	ErrInvalidPatch    = fmt.Errorf("ErrInvalidPatch")
+	ErrPatchTestFailed = fmt.Errorf("ErrPatchTestFailed")
+)
+
+// PatchOperation is a RFC 6902 JSON Patch operation
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// MergePatch applies a RFC 7396 JSON Merge Patch to a JSON document
+func MergePatch(document, patch []byte) ([]byte, error) {
+	target, err := decodeJSON(document)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := decodeJSON(patch)
+	if err != nil {
+		return nil, ErrInvalidPatch
+	}
+	return json.Marshal(mergePatch(target, changes))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// JSONPatch applies a RFC 6902 JSON Patch to a JSON document.
+// It returns ErrPatchTestFailed if a "test" operation fails.
+func JSONPatch(document, patch []byte) ([]byte, error) {
+	target, err := decodeJSON(document)
+	if err != nil {
+		return nil, err
+	}
+	operations := []PatchOperation{}
+	if err = json.Unmarshal(patch, &operations); err != nil {
+		return nil, ErrInvalidPatch
+	}
+	for _, operation := range operations {
+		if target, err = applyOperation(target, operation); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(target)
+}
+
+func applyOperation(document interface{}, operation PatchOperation) (interface{}, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if len(operation.Value) == 0 {
+			return nil, ErrInvalidPatch
+		}
+		value, err := decodeJSON(operation.Value)
+		if err != nil {
+			return nil, ErrInvalidPatch
+		}
+		switch operation.Op {
+		case "add":
+			return setValue(document, path, value, true)
+		case "replace":
+			return setValue(document, path, value, false)
+		}
+		current, err := getValue(document, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, ErrPatchTestFailed
+		}
+		return document, nil
+	case "remove":
+		return removeValue(document, path)
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getValue(document, from)
+		if err != nil {
+			return nil, err
+		}
+		if operation.Op == "move" {
+			if document, err = removeValue(document, from); err != nil {
+				return nil, err
+			}
+		} else if value, err = decodeJSON(mustMarshal(value)); err != nil {
+			// copies are deep copies
+			return nil, err
+		}
+		return setValue(document, path, value, true)
+	}
+	return nil, ErrInvalidPatch
+}
+
+// parsePointer parses a RFC 6901 JSON Pointer
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, ErrInvalidPatch
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses the index of an array element, "-" is the index
+// after the last element if allowEnd is true
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > length || (index == length && !allowEnd) || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, ErrInvalidPatch
+	}
+	return index, nil
+}
+
+func getValue(document interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := document.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, ErrInvalidPatch
+			}
+			document = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			document = container[index]
+		default:
+			return nil, ErrInvalidPatch
+		}
+	}
+	return document, nil
+}
+
+// setValue sets the value at path, insert is true for "add" operations
+// which insert array elements and create object members
+func setValue(document interface{}, path []string, value interface{}, insert bool) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, last := path[0], len(path) == 1
+	switch container := document.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if last {
+			if !ok && !insert {
+				return nil, ErrInvalidPatch
+			}
+			container[token] = value
+			return container, nil
+		}
+		if !ok {
+			return nil, ErrInvalidPatch
+		}
+		child, err := setValue(child, path[1:], value, insert)
+		if err != nil {
+			return nil, err
+		}
+		container[token] = child
+		return container, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(container), last && insert)
+		if err != nil {
+			return nil, err
+		}
+		if !last {
+			if container[index], err = setValue(container[index], path[1:], value, insert); err != nil {
+				return nil, err
+			}
+			return container, nil
+		}
+		if !insert {
+			container[index] = value
+			return container, nil
+		}
+		container = append(container, nil)
+		copy(container[index+1:], container[index:])
+		container[index] = value
+		return container, nil
+	}
+	return nil, ErrInvalidPatch
+}
+
+func removeValue(document interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, ErrInvalidPatch
+	}
+	token, last := path[0], len(path) == 1
+	switch container := document.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, ErrInvalidPatch
+		}
+		if last {
+			delete(container, token)
+			return container, nil
+		}
+		child, err := removeValue(child, path[1:])
+		if err != nil {
+			return nil, err
+		}
+		container[token] = child
+		return container, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(container), false)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			return append(container[:index], container[index+1:]...), nil
+		}
+		if container[index], err = removeValue(container[index], path[1:]); err != nil {
+			return nil, err
+		}
+		return container, nil
+	}
+	return nil, ErrInvalidPatch
+}
+
+// decodeJSON decodes a JSON document, numbers are decoded as json.Number
+// so that int64 values are not rounded
+func decodeJSON(document []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func mustMarshal(value interface{}) []byte {
+	document, _ := json.Marshal(value)
+	return document
+}
+
+// resetJSONFields zeroes the fields of a struct that are encoded in JSON,
+// so that decoding a JSON document into the struct doesn't keep removed values
+// while fields hidden from JSON are preserved
+func resetJSONFields(value reflect.Value) {
+	value = reflect.Indirect(value)
+	if value.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Tag.Get("json") == "-" {
+			continue
+		}
+		if field.Anonymous && reflect.Indirect(value.Field(i)).Kind() == reflect.Struct {
+			resetJSONFields(value.Field(i))
+			continue
+		}
+		if field.PkgPath == "" {
+			value.Field(i).Set(reflect.Zero(field.Type))
+		}
+	}
+}
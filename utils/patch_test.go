@@ -0,0 +1,83 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Mparaiso/appengine/utils"
+	"github.com/Mparaiso/go-tiger/test"
+)
+
+// equalJSON returns true if two JSON documents are equal
+func equalJSON(t *testing.T, a, b []byte) bool {
+	var va, vb interface{}
+	test.Fatal(t, json.Unmarshal(a, &va), nil)
+	test.Fatal(t, json.Unmarshal(b, &vb), nil)
+	return reflect.DeepEqual(va, vb)
+}
+
+// Given a document and a merge patch
+// MergePatch should apply the patch according to RFC 7396
+func TestMergePatch(t *testing.T) {
+	for _, fixture := range []struct{ Document, Patch, Expected string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`{"ID":9007199254740993}`, `{"a":1}`, `{"ID":9007199254740993,"a":1}`},
+	} {
+		result, err := utils.MergePatch([]byte(fixture.Document), []byte(fixture.Patch))
+		test.Fatal(t, err, nil)
+		test.Error(t, equalJSON(t, result, []byte(fixture.Expected)), true, fixture.Patch, string(result))
+	}
+}
+
+// Given a document and a JSON patch
+// JSONPatch should apply the patch according to RFC 6902
+func TestJSONPatch(t *testing.T) {
+	for _, fixture := range []struct{ Document, Patch, Expected string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"baz"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"foo":{"bar":1},"baz":{"bar":1}}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1},{"op":"remove","path":"/m~0n"}]`, `{"a/b":1}`},
+	} {
+		result, err := utils.JSONPatch([]byte(fixture.Document), []byte(fixture.Patch))
+		test.Fatal(t, err, nil, fixture.Patch)
+		test.Error(t, equalJSON(t, result, []byte(fixture.Expected)), true, fixture.Patch, string(result))
+	}
+	_, err := utils.JSONPatch([]byte(`{"baz":"qux"}`), []byte(`[{"op":"test","path":"/baz","value":"bar"}]`))
+	test.Error(t, err, utils.ErrPatchTestFailed)
+	for _, patch := range []string{
+		`[{"op":"remove","path":"/missing"}]`,
+		`[{"op":"replace","path":"/missing","value":1}]`,
+		`[{"op":"add","path":"/foo/5","value":1}]`,
+		`[{"op":"unknown","path":"/foo"}]`,
+		`{"op":"add"}`,
+	} {
+		_, err := utils.JSONPatch([]byte(`{"foo":[]}`), []byte(patch))
+		test.Error(t, err, utils.ErrInvalidPatch, patch)
+	}
+}
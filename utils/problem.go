@@ -0,0 +1,80 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Mparaiso/appengine/datastore"
+)
+
+// ProblemContentType is the content type of a RFC 7807 problem details response
+const ProblemContentType = "application/problem+json"
+
+// Problem is a RFC 7807 problem details object,
+// Errors holds the error messages of each invalid field or parameter
+type Problem struct {
+	Type     string              `json:"type"`
+	Title    string              `json:"title"`
+	Status   int                 `json:"status"`
+	Detail   string              `json:"detail,omitempty"`
+	Instance string              `json:"instance,omitempty"`
+	Errors   map[string][]string `json:"errors,omitempty"`
+}
+
+// NewProblem returns the problem details of an error.
+// Field errors are read from the Errors property of the JSON encoding of err,
+// which is how ParameterError and validation errors are encoded
+func NewProblem(err error, status int) *Problem {
+	problem := &Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: err.Error()}
+	if document, e := json.Marshal(err); e == nil {
+		fields := &struct{ Errors map[string][]string }{}
+		if e = json.Unmarshal(document, fields); e == nil && len(fields.Errors) > 0 {
+			problem.Errors = fields.Errors
+		}
+	}
+	return problem
+}
+
+// WriteProblem writes the problem details of an error, it is the default Resource.ErrorFunction
+func WriteProblem(w http.ResponseWriter, err error, status int) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(NewProblem(err, status))
+}
+
+// StatusOf returns the HTTP status of known errors, or status for other errors
+func StatusOf(err error, status int) int {
+	var parameterError *ParameterError
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, datastore.ErrNoSuchEntity):
+		return http.StatusNotFound
+	case errors.Is(err, datastore.ErrEntityLocked):
+		return http.StatusLocked
+	case errors.Is(err, datastore.ErrVersionMismatch), errors.Is(err, datastore.ErrDeleteRestricted), errors.Is(err, datastore.ErrEntityExists),
+		errors.Is(err, ErrPatchTestFailed):
+		return http.StatusConflict
+	case errors.As(err, &parameterError), errors.As(err, &syntaxError), errors.As(err, &unmarshalTypeError),
+		errors.Is(err, datastore.ErrInvalidCursor), errors.Is(err, ErrInvalidPatch),
+		errors.Is(err, ErrInvalidParentKey):
+		return http.StatusBadRequest
+	}
+	return status
+}
@@ -0,0 +1,72 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Mparaiso/appengine/datastore"
+	"github.com/Mparaiso/appengine/utils"
+	"github.com/Mparaiso/go-tiger/test"
+)
+
+// Given an error with field errors
+// When WriteProblem is called
+// It should write a problem+json response with the field errors
+func TestWriteProblem(t *testing.T) {
+	err := &utils.ParameterError{}
+	err.Append("limit", "must be a positive integer")
+	response := httptest.NewRecorder()
+	utils.WriteProblem(response, err, http.StatusBadRequest)
+	test.Fatal(t, response.Code, http.StatusBadRequest)
+	test.Error(t, response.Header().Get("Content-Type"), utils.ProblemContentType)
+	problem := &utils.Problem{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(problem), nil)
+	test.Error(t, problem.Status, http.StatusBadRequest)
+	test.Error(t, problem.Title, "Bad Request")
+	test.Error(t, problem.Detail, err.Error())
+	test.Error(t, len(problem.Errors["limit"]), 1)
+
+	problem = utils.NewProblem(fmt.Errorf("error"), http.StatusInternalServerError)
+	test.Error(t, len(problem.Errors), 0)
+}
+
+// Given known errors
+// StatusOf should return their status
+func TestStatusOf(t *testing.T) {
+	for _, fixture := range []struct {
+		Error  error
+		Status int
+	}{
+		{datastore.ErrNoSuchEntity, http.StatusNotFound},
+		{datastore.ErrEntityLocked, http.StatusLocked},
+		{fmt.Errorf("wrapped: %w", datastore.ErrEntityLocked), http.StatusLocked},
+		{&datastore.ErrVersionConflict{Expected: 2, Actual: 1}, http.StatusConflict},
+		{&datastore.ErrReferenced{Kind: "order", Field: "Customer"}, http.StatusConflict},
+		{datastore.ErrEntityExists, http.StatusConflict},
+		{utils.ErrPatchTestFailed, http.StatusConflict},
+		{&utils.ParameterError{}, http.StatusBadRequest},
+		{json.Unmarshal([]byte("{"), &struct{}{}), http.StatusBadRequest},
+		{datastore.ErrInvalidCursor, http.StatusBadRequest},
+		{fmt.Errorf("%w : %s", utils.ErrInvalidParentKey, "abc"), http.StatusBadRequest},
+		{fmt.Errorf("error"), http.StatusInternalServerError},
+	} {
+		test.Error(t, utils.StatusOf(fixture.Error, http.StatusInternalServerError), fixture.Status, fixture.Error)
+	}
+}
@@ -0,0 +1,271 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mparaiso/appengine/datastore"
+	appengine_datastore "google.golang.org/appengine/datastore"
+)
+
+// ParameterError is returned when query string parameters are invalid,
+// Errors holds the error messages of each invalid parameter
+type ParameterError struct {
+	Errors map[string][]string
+}
+
+// Append appends an error message for a parameter
+func (err *ParameterError) Append(parameter, message string) {
+	if err.Errors == nil {
+		err.Errors = map[string][]string{}
+	}
+	err.Errors[parameter] = append(err.Errors[parameter], message)
+}
+
+func (err *ParameterError) Error() string {
+	return fmt.Sprintf("Invalid parameters : %v", err.Errors)
+}
+
+// operators maps the operators of filter parameters to datastore operators
+var operators = map[string]datastore.Operator{
+	"eq":  datastore.Eq,
+	"ne":  datastore.Ne,
+	"lt":  datastore.Lt,
+	"lte": datastore.Lte,
+	"gt":  datastore.Gt,
+	"gte": datastore.Gte,
+	"in":  datastore.In,
+}
+
+// ParseQuery parses the query string of an Index request :
+//
+//	?filter[Username]=john&filter[Age][gte]=18&filter[Country][in]=FR,US&sort=-Created&fields=ID,Username&limit=20
+//
+// Fields must be listed in FilterableFields, SortableFields and SelectableFields.
+// The limit defaults to ResultPerPage and cannot exceed it.
+// Like the datastore, only one field can be filtered with inequalities, including ne,
+// and the first sorted field must be that field.
+func (resource Resource) ParseQuery(values url.Values) (datastore.Query, error) {
+	query := datastore.Query{Limit: resource.ResultPerPage}
+	errors := &ParameterError{}
+	// inequalities lists the fields filtered with inequalities
+	inequalities := []string{}
+	// parameters are sorted so that filters are applied in a predictable order
+	parameters := make([]string, 0, len(values))
+	for parameter := range values {
+		parameters = append(parameters, parameter)
+	}
+	sort.Strings(parameters)
+	for _, parameter := range parameters {
+		value := values.Get(parameter)
+		switch {
+		case strings.HasPrefix(parameter, "filter["):
+			field, operator, ok := parseFilterParameter(parameter)
+			if !ok {
+				errors.Append(parameter, "is not a valid filter, expected filter[Field] or filter[Field][operator]")
+				continue
+			}
+			if !contains(resource.FilterableFields, field) {
+				errors.Append(parameter, fmt.Sprintf("%s cannot be filtered", field))
+				continue
+			}
+			if operator == datastore.In {
+				in := []interface{}{}
+				for _, v := range strings.Split(value, ",") {
+					converted, err := resource.convert(field, v)
+					if err != nil {
+						errors.Append(parameter, err.Error())
+						in = nil
+						break
+					}
+					in = append(in, converted)
+				}
+				if in != nil {
+					query = query.In(field, in...)
+				}
+				continue
+			}
+			converted, err := resource.convert(field, value)
+			if err != nil {
+				errors.Append(parameter, err.Error())
+				continue
+			}
+			if operator != datastore.Eq && !contains(inequalities, field) {
+				inequalities = append(inequalities, field)
+			}
+			query = query.Where(field, operator, converted)
+		case parameter == "sort":
+			for _, order := range strings.Split(value, ",") {
+				if !contains(resource.SortableFields, strings.TrimPrefix(order, "-")) {
+					errors.Append(parameter, fmt.Sprintf("%s cannot be sorted", strings.TrimPrefix(order, "-")))
+					continue
+				}
+				query = query.OrderBy(order)
+			}
+		case parameter == "fields":
+			for _, field := range strings.Split(value, ",") {
+				if !contains(resource.SelectableFields, field) {
+					errors.Append(parameter, fmt.Sprintf("%s cannot be selected", field))
+					continue
+				}
+				query = query.Project(field)
+			}
+		case parameter == "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 || (resource.ResultPerPage > 0 && limit > resource.ResultPerPage) {
+				if resource.ResultPerPage > 0 {
+					errors.Append(parameter, fmt.Sprintf("must be an integer between 1 and %d", resource.ResultPerPage))
+				} else {
+					errors.Append(parameter, "must be a positive integer")
+				}
+				continue
+			}
+			query.Limit = limit
+		}
+	}
+	if len(inequalities) > 1 {
+		errors.Append("filter", fmt.Sprintf("only one field can be filtered with inequalities, %s are", strings.Join(inequalities, ", ")))
+	} else if len(inequalities) == 1 && len(query.Order) > 0 && strings.TrimPrefix(query.Order[0], "-") != inequalities[0] {
+		errors.Append("sort", fmt.Sprintf("must start with %s, the field filtered with an inequality", inequalities[0]))
+	}
+	if len(errors.Errors) > 0 {
+		return query, errors
+	}
+	return query, nil
+}
+
+// ParseInclude parses the include parameter of a request, a comma separated
+// list of fields matched case insensitively against IncludableFields :
+//
+//	?include=author,tags
+func (resource Resource) ParseInclude(values url.Values) ([]string, error) {
+	fields := []string{}
+	errors := &ParameterError{}
+	value := values.Get("include")
+	if value == "" {
+		return fields, nil
+	}
+	for _, name := range strings.Split(value, ",") {
+		field, ok := "", false
+		for _, includable := range resource.IncludableFields {
+			if strings.EqualFold(includable, name) {
+				field, ok = includable, true
+				break
+			}
+		}
+		if !ok {
+			errors.Append("include", fmt.Sprintf("%s cannot be included", name))
+			continue
+		}
+		fields = append(fields, field)
+	}
+	if len(errors.Errors) > 0 {
+		return nil, errors
+	}
+	return fields, nil
+}
+
+// parseFilterParameter parses filter[Field] and filter[Field][operator]
+func parseFilterParameter(parameter string) (string, datastore.Operator, bool) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(parameter, "filter["), "]"), "][")
+	switch len(parts) {
+	case 1:
+		return parts[0], datastore.Eq, parts[0] != ""
+	case 2:
+		operator, ok := operators[parts[1]]
+		return parts[0], operator, ok && parts[0] != ""
+	}
+	return "", "", false
+}
+
+// convert converts a query string value to the type of a field of the prototype
+func (resource Resource) convert(field string, value string) (interface{}, error) {
+	structField, ok := resource.GetPrototype().FieldByName(field)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a field", field)
+	}
+	converted, err := convert(structField.Type, value)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid %s", value, structField.Type)
+	}
+	return converted, nil
+}
+
+func convert(t reflect.Type, value string) (interface{}, error) {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return time.Parse(time.RFC3339, value)
+	case t == reflect.TypeOf(&appengine_datastore.Key{}):
+		return appengine_datastore.DecodeKey(value)
+	case t.Kind() == reflect.String:
+		return value, nil
+	case t.Kind() == reflect.Bool:
+		return strconv.ParseBool(value)
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		return reflect.ValueOf(i).Convert(t).Interface(), err
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, 64)
+		return reflect.ValueOf(u).Convert(t).Interface(), err
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		return reflect.ValueOf(f).Convert(t).Interface(), err
+	}
+	return nil, fmt.Errorf("%s cannot be converted from a string", t)
+}
+
+// sparse encodes entities keeping only the JSON properties of fields
+func sparse(entities interface{}, fields []string) ([]map[string]json.RawMessage, error) {
+	items := reflect.Indirect(reflect.ValueOf(entities))
+	result := make([]map[string]json.RawMessage, 0, items.Len())
+	for i := 0; i < items.Len(); i++ {
+		item := reflect.Indirect(items.Index(i))
+		selected := map[string]json.RawMessage{}
+		for _, field := range fields {
+			structField, ok := item.Type().FieldByName(field)
+			name := strings.Split(structField.Tag.Get("json"), ",")[0]
+			if !ok || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field
+			}
+			value, err := json.Marshal(item.FieldByIndex(structField.Index).Interface())
+			if err != nil {
+				return nil, err
+			}
+			selected[name] = value
+		}
+		result = append(result, selected)
+	}
+	return result, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
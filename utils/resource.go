@@ -17,13 +17,17 @@ package utils
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"reflect"
+	"sync"
 
 	"golang.org/x/net/context"
 
 	"github.com/Mparaiso/appengine/datastore"
 	"google.golang.org/appengine"
+	appengine_datastore "google.golang.org/appengine/datastore"
 )
 
 // Entity is a datastore entity
@@ -32,56 +36,121 @@ type Entity interface {
 	SetID(int64)
 }
 
+// ParentKeyResolver resolves the parent key of the entities of a request,
+// for instance from the parameters of a nested route such as /projects/:project/tasks/:task.
+// Its errors are wrapped in ErrInvalidParentKey, responded with 400, unless StatusOf
+// maps them to a status, such as datastore.ErrNoSuchEntity for a missing parent, responded with 404
+type ParentKeyResolver func(ctx context.Context, r *http.Request) (*appengine_datastore.Key, error)
+
+// RepositoryFactory creates the repository of the entities of a request
+type RepositoryFactory func(r *http.Request) (datastore.Repository, error)
+
 // Validator valides an entity or return an error if the entity is invalid.
 type Validator func(cxt context.Context, r *http.Request, entity Entity) error
 
-// CreatedMessage is returned when a new entity is created
+// CreatedMessage is returned when a new entity is created,
+// Name is set when the entity is a datastore.NamedEntity
 type CreatedMessage struct {
 	Status  int
 	Message string
 	ID      int64
+	Name    string `json:",omitempty"`
 }
 
+// CursorHeader is the response header of Index holding the cursor of the next page,
+// it is not set when there is no next page
+const CursorHeader = "X-Cursor"
+
 // Resource is a reusable rest endpoint
 type Resource struct {
 	// Prototype is a value used to create other values
-	Prototype       Entity
-	CreatePrototype Entity
-	UpdatePrototype Entity
+	Prototype Entity
+	// CreatePrototype and UpdatePrototype are the values Post and Put decode requests into
+	// before mapping them onto the entity, if set. Fields they do not declare cannot be written by clients.
+	// See Mapper
+	CreatePrototype interface{}
+	UpdatePrototype interface{}
+	// OutputPrototype is the value entities are mapped onto before being encoded in responses, if set
+	OutputPrototype interface{}
 	protoType       reflect.Type
 	// the datastore kind
-	Kind          string
-	Signal        datastore.Signal
+	Kind   string
+	Signal datastore.Signal
+	// ResultPerPage is the maximum number of entities listed by Index, 0 means no limit
 	ResultPerPage int
+	// FilterableFields, SortableFields and SelectableFields list the fields
+	// Index can filter, sort and project, see ParseQuery
+	FilterableFields []string
+	SortableFields   []string
+	SelectableFields []string
+	// IncludableFields lists the datastore.Ref fields Index and Get
+	// load with the "include" parameter, see ParseInclude
+	IncludableFields []string
+	// ErrorFunction writes the errors of the handlers, see GetErrorFunction
 	ErrorFunction func(writer http.ResponseWriter, Error error, status int)
-	validator     Validator
+	// IDExtractor reads the ID of the entity of a request, see GetIDExtractor
+	IDExtractor IDExtractor
+	// ParentKeyResolver scopes the entities of a request to a parent entity, if set.
+	// The repository must be a datastore.ParentKeySetter
+	ParentKeyResolver ParentKeyResolver
+	// RepositoryFactory creates the repositories of the handlers, a DefaultRepository
+	// dispatching to Signal is used if not set
+	RepositoryFactory RepositoryFactory
+	// ContextFactory creates the contexts of the handlers, appengine.NewContext is used if not set
+	ContextFactory datastore.ContextFactory
+	validator      Validator
+	// factory and sliceFactory create entities and pointers to slices of entities,
+	// reflection is used if they are not set
+	factory      func() Entity
+	sliceFactory func() interface{}
 }
 
 // GetCreatePrototype returns resource.CreatePrototype
-func (resource Resource) GetCreatePrototype() Entity {
+func (resource Resource) GetCreatePrototype() interface{} {
 	return resource.CreatePrototype
 }
 
 // SetCreatePrototype sets resource.CreatePrototype
-func (resource *Resource) SetCreatePrototype(CreatePrototype Entity) {
+func (resource *Resource) SetCreatePrototype(CreatePrototype interface{}) {
 	resource.CreatePrototype = CreatePrototype
 }
 
 // GetUpdatePrototype returns resource.UpdatePrototype
-func (resource Resource) GetUpdatePrototype() Entity {
+func (resource Resource) GetUpdatePrototype() interface{} {
 	return resource.UpdatePrototype
 }
 
 // SetUpdatePrototype sets resource.UpdatePrototype
-func (resource *Resource) SetUpdatePrototype(UpdatePrototype Entity) {
+func (resource *Resource) SetUpdatePrototype(UpdatePrototype interface{}) {
 	resource.UpdatePrototype = UpdatePrototype
 }
 
+// GetOutputPrototype returns resource.OutputPrototype
+func (resource Resource) GetOutputPrototype() interface{} {
+	return resource.OutputPrototype
+}
+
+// SetOutputPrototype sets resource.OutputPrototype
+func (resource *Resource) SetOutputPrototype(OutputPrototype interface{}) {
+	resource.OutputPrototype = OutputPrototype
+}
+
+var (
+	ErrParentKeyNotSupported = fmt.Errorf("The repository cannot be scoped to a parent key")
+	ErrIncludeNotSupported   = fmt.Errorf("The repository cannot include referenced entities")
+	ErrInvalidParentKey      = fmt.Errorf("The parent key of the request is invalid")
+)
+
 // NewResource creates a new EndPoint
 func NewResource(prototype Entity, Kind string) *Resource {
-	return &Resource{Prototype: prototype, Kind: Kind}
+	resource := &Resource{Prototype: prototype, Kind: Kind, Signal: datastore.NewDefaultSignal()}
+	resource.GetPrototype()
+	return resource
 }
 
+// lazyMutex guards the fields of resources initialized on first use
+var lazyMutex sync.Mutex
+
 // SetValidator sets a validator that can be used to validate an entity before it is persisted
 // the validator MUST return the entity AND nil if no error
 func (resource *Resource) SetValidator(validator Validator) {
@@ -107,93 +176,411 @@ func (resource *Resource) GetKind() string {
 	return resource.Kind
 }
 
-// GetErrorFunction returns the function used to manage errors
+// GetErrorFunction returns the function used to manage errors,
+// WriteProblem by default
 func (resource *Resource) GetErrorFunction() func(http.ResponseWriter, error, int) {
 	if resource.ErrorFunction == nil {
-		resource.ErrorFunction = func(w http.ResponseWriter, err error, status int) { http.Error(w, err.Error(), status) }
+		resource.ErrorFunction = WriteProblem
 	}
 	return resource.ErrorFunction
 }
 
+// fail writes an error with the status returned by StatusOf
+func (resource Resource) fail(w http.ResponseWriter, err error, status int) {
+	resource.GetErrorFunction()(w, err, StatusOf(err, status))
+}
+
 // GetPrototype returns r.Prototype
 func (r *Resource) GetPrototype() reflect.Type {
+	lazyMutex.Lock()
+	defer lazyMutex.Unlock()
 	if r.protoType == nil {
 		r.protoType = reflect.Indirect(reflect.ValueOf(r.Prototype)).Type()
 	}
 	return r.protoType
 }
 
-// Index list resources
+// Index list resources in a JSON array. The cursor of the next page is sent in the CursorHeader
+// and in a Link header, the "cursor" query parameter is used to fetch the next page. Entities can be filtered, sorted
+// and projected with query string parameters, see ParseQuery,
+// and their references embedded with the include parameter, see ParseInclude
 func (resource Resource) Index(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	repository := datastore.NewDefaultRepositoryWithSignal(ctx, resource.Kind, resource.GetSignal())
-	entities := reflect.New(reflect.SliceOf(resource.GetPrototype())).Interface()
-	err := repository.FindAll(entities)
+	query, err := resource.ParseQuery(r.URL.Query())
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusInternalServerError)
+		resource.fail(w, err, http.StatusBadRequest)
 		return
 	}
-	err = json.NewEncoder(w).Encode(entities)
+	ctx := resource.Context(r)
+	repository, err := resource.repository(ctx, r)
+	if err == nil {
+		repository, err = resource.include(repository, r)
+	}
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusInternalServerError)
+		resource.fail(w, err, http.StatusInternalServerError)
+		return
 	}
+	entities := resource.newEntities()
+	cursor, err := repository.FindPage(query, r.URL.Query().Get("cursor"), entities)
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	items, err := resource.outputs(entities)
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	if len(query.Fields) > 0 {
+		if items, err = sparse(items, query.Fields); err != nil {
+			resource.fail(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if cursor != "" {
+		next := *r.URL
+		values := next.Query()
+		values.Set("cursor", cursor)
+		next.RawQuery = values.Encode()
+		w.Header().Set(CursorHeader, cursor)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	}
+	err = json.NewEncoder(w).Encode(items)
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
+	}
+}
+
+// Context returns the context of a request, created by the ContextFactory if set
+func (resource Resource) Context(r *http.Request) context.Context {
+	if resource.ContextFactory != nil {
+		return resource.ContextFactory.Create(r)
+	}
+	return appengine.NewContext(r)
 }
 
-// GetSignal returns a signal dispatcher
+// repository returns a repository scoped to the parent key of the request,
+// it returns datastore.ErrNoSuchEntity if the parent entity does not exist
+func (resource Resource) repository(ctx context.Context, r *http.Request) (datastore.Repository, error) {
+	var repository datastore.Repository
+	if resource.RepositoryFactory != nil {
+		var err error
+		if repository, err = resource.RepositoryFactory(r); err != nil {
+			return nil, err
+		}
+	} else {
+		repository = datastore.NewDefaultRepositoryWithSignal(ctx, resource.Kind, resource.GetSignal())
+	}
+	if setter, ok := repository.(datastore.EntityFactorySetter); ok && resource.factory != nil {
+		factory := resource.factory
+		setter.SetNew(func() datastore.Entity { return factory() })
+	}
+	if resource.ParentKeyResolver == nil {
+		return repository, nil
+	}
+	setter, ok := repository.(datastore.ParentKeySetter)
+	if !ok {
+		return nil, ErrParentKeyNotSupported
+	}
+	parentKey, err := resource.ParentKeyResolver(ctx, r)
+	if err != nil {
+		if StatusOf(err, 0) != 0 {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w : %s", ErrInvalidParentKey, err)
+	}
+	if checker, ok := repository.(datastore.ExistenceChecker); ok && parentKey != nil {
+		exists, err := checker.Exists(parentKey)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, datastore.ErrNoSuchEntity
+		}
+	}
+	setter.SetParentKey(parentKey)
+	return repository, nil
+}
+
+// include returns a repository loading the references listed by the include parameter of r
+func (resource Resource) include(repository datastore.Repository, r *http.Request) (datastore.Repository, error) {
+	fields, err := resource.ParseInclude(r.URL.Query())
+	if err != nil || len(fields) == 0 {
+		return repository, err
+	}
+	includer, ok := repository.(datastore.Includer)
+	if !ok {
+		return nil, ErrIncludeNotSupported
+	}
+	return includer.Include(fields...), nil
+}
+
+// Key returns the key of the entity of a request, scoped to the parent key of the request.
+// The entity does not have to exist
+func (resource Resource) Key(r *http.Request) (*appengine_datastore.Key, error) {
+	entity := resource.newEntity()
+	if err := resource.identify(r, entity); err != nil {
+		return nil, err
+	}
+	ctx := resource.Context(r)
+	repository, err := resource.repository(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	var parentKey *appengine_datastore.Key
+	if setter, ok := repository.(datastore.ParentKeySetter); ok {
+		parentKey = setter.GetParentKey()
+	}
+	if named, ok := entity.(datastore.NamedEntity); ok {
+		return appengine_datastore.NewKey(ctx, resource.Kind, named.GetName(), 0, parentKey), nil
+	}
+	return appengine_datastore.NewKey(ctx, resource.Kind, "", entity.GetID(), parentKey), nil
+}
+
+// newEntity returns a new entity
+func (resource Resource) newEntity() Entity {
+	if resource.factory != nil {
+		return resource.factory()
+	}
+	return reflect.New(resource.GetPrototype()).Interface().(Entity)
+}
+
+// newEntities returns a pointer to a new slice of entities
+func (resource Resource) newEntities() interface{} {
+	if resource.sliceFactory != nil {
+		return resource.sliceFactory()
+	}
+	return reflect.New(reflect.SliceOf(resource.GetPrototype())).Interface()
+}
+
+// GetSignal returns a signal dispatcher, created on first use if Signal is not set.
+// Handlers are called on copies of the resource, so a resource not created with NewResource
+// should set Signal or call GetSignal before serving requests.
 func (r *Resource) GetSignal() datastore.Signal {
+	lazyMutex.Lock()
+	defer lazyMutex.Unlock()
 	if r.Signal == nil {
 		r.Signal = datastore.NewDefaultSignal()
 	}
 	return r.Signal
 }
 
-// Get fetches a resource
-func (resource Resource) Get(w http.ResponseWriter, r *http.Request) {
-
+// identify sets the ID of entity, or its name if entity is a datastore.NamedEntity,
+// from the request parameter read by the IDExtractor
+func (resource Resource) identify(r *http.Request, entity Entity) error {
+	param := resource.GetIDExtractor()(r, resource.Kind)
+	if named, ok := entity.(datastore.NamedEntity); ok {
+		if param == "" {
+			return datastore.ErrEmptyName
+		}
+		named.SetName(param)
+		return nil
+	}
 	var id int64
-	_, err := fmt.Sscanf(r.URL.Query().Get(":"+resource.Kind), "%d", &id)
+	if _, err := fmt.Sscanf(param, "%d", &id); err != nil {
+		return err
+	}
+	entity.SetID(id)
+	return nil
+}
+
+// find loads an identified entity from the repository
+func find(repository datastore.Repository, entity Entity) error {
+	if named, ok := entity.(datastore.NamedEntity); ok {
+		return repository.FindByName(named.GetName(), entity)
+	}
+	return repository.FindByID(entity.GetID(), entity)
+}
+
+// output returns the value encoded in responses for an entity,
+// the entity mapped onto a new OutputPrototype if set
+func (resource Resource) output(entity Entity) (interface{}, error) {
+	if resource.OutputPrototype == nil {
+		return entity, nil
+	}
+	output := newValue(resource.OutputPrototype)
+	return output, mapValue(output, entity)
+}
+
+// outputs returns the values encoded in responses for a pointer to a slice of entities
+func (resource Resource) outputs(entities interface{}) (interface{}, error) {
+	if resource.OutputPrototype == nil {
+		return entities, nil
+	}
+	values := reflect.Indirect(reflect.ValueOf(entities))
+	outputs := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(newValue(resource.OutputPrototype))), 0, values.Len())
+	for i := 0; i < values.Len(); i++ {
+		value := values.Index(i)
+		if value.Kind() != reflect.Ptr {
+			value = value.Addr()
+		}
+		output, err := resource.output(value.Interface().(Entity))
+		if err != nil {
+			return nil, err
+		}
+		outputs = reflect.Append(outputs, reflect.ValueOf(output))
+	}
+	return outputs.Interface(), nil
+}
+
+// Get fetches a resource, references listed by the include parameter are embedded
+func (resource Resource) Get(w http.ResponseWriter, r *http.Request) {
+	entity := resource.newEntity()
+	err := resource.identify(r, entity)
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusBadRequest)
+		resource.fail(w, err, http.StatusBadRequest)
 		return
 	}
-	entity := reflect.New(resource.GetPrototype()).Interface().(Entity)
-	ctx := appengine.NewContext(r)
-	repository := datastore.NewDefaultRepositoryWithSignal(ctx, resource.Kind, resource.GetSignal())
-	err = repository.FindByID(id, entity)
-	if err == datastore.ErrNoSuchEntity {
-		resource.GetErrorFunction()(w, err, http.StatusNotFound)
+	ctx := resource.Context(r)
+	repository, err := resource.repository(ctx, r)
+	if err == nil {
+		repository, err = resource.include(repository, r)
+	}
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
 		return
-	} else if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusInternalServerError)
+	}
+	err = find(repository, entity)
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
 		return
 	}
-	err = json.NewEncoder(w).Encode(entity)
+	output, err := resource.output(entity)
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusInternalServerError)
+		resource.fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(output)
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
 	}
 }
 
-// Put updates a resource
+// Put updates a resource. If UpdatePrototype is set, the request is decoded
+// into a new UpdatePrototype which is mapped onto the stored entity
 func (resource Resource) Put(w http.ResponseWriter, r *http.Request) {
-	var id int64
-	_, err := fmt.Sscanf(r.URL.Query().Get(":"+resource.Kind), "%d", &id)
+	entity := resource.newEntity()
+	var input interface{} = entity
+	if resource.UpdatePrototype != nil {
+		input = newValue(resource.UpdatePrototype)
+	}
+	err := json.NewDecoder(r.Body).Decode(input)
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusBadRequest)
+		resource.fail(w, err, http.StatusBadRequest)
+		return
+	}
+	if err = resource.identify(r, entity); err != nil {
+		resource.fail(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx := resource.Context(r)
+	repository, err := resource.repository(ctx, r)
+	if err == nil && input != entity {
+		err = find(repository, entity)
+	}
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	if input != entity {
+		if err = mapValue(entity, input); err != nil {
+			resource.fail(w, err, http.StatusBadRequest)
+			return
+		}
+		// the update prototype cannot change the identity of the entity
+		if err = resource.identify(r, entity); err != nil {
+			resource.fail(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	if err = resource.Validate(ctx, r, entity); err != nil {
+		resource.fail(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	err = repository.Update(entity)
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Patch partially updates a resource. The request body is a JSON Merge Patch
+// if its content type is MergePatchContentType or "application/json",
+// a JSON Patch if its content type is JSONPatchContentType.
+// If UpdatePrototype is set, only the fields of the UpdatePrototype can be patched
+func (resource Resource) Patch(w http.ResponseWriter, r *http.Request) {
+	var apply func(document, patch []byte) ([]byte, error)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case MergePatchContentType, "application/json":
+		apply = MergePatch
+	case JSONPatchContentType:
+		apply = JSONPatch
+	default:
+		resource.fail(w, fmt.Errorf("Unsupported content type %q", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		resource.fail(w, err, http.StatusBadRequest)
+		return
+	}
+	entity := resource.newEntity()
+	if err = resource.identify(r, entity); err != nil {
+		resource.fail(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx := resource.Context(r)
+	repository, err := resource.repository(ctx, r)
+	if err == nil {
+		err = find(repository, entity)
+	}
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	var target interface{} = entity
+	if resource.UpdatePrototype != nil {
+		target = newValue(resource.UpdatePrototype)
+		if err = CopyFields(target, entity); err != nil {
+			resource.fail(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	document, err := json.Marshal(target)
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	document, err = apply(document, patch)
+	if err != nil {
+		resource.fail(w, err, http.StatusBadRequest)
+		return
+	}
+	// fields hidden from JSON keep their stored values
+	resetJSONFields(reflect.ValueOf(target))
+	if err = json.Unmarshal(document, target); err != nil {
+		resource.fail(w, err, http.StatusBadRequest)
+		return
+	}
+	if target != entity {
+		if err = mapValue(entity, target); err != nil {
+			resource.fail(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	// the patch cannot change the identity of the entity
+	if err = resource.identify(r, entity); err != nil {
+		resource.fail(w, err, http.StatusBadRequest)
 		return
 	}
-	entity := reflect.New(resource.GetPrototype()).Interface().(Entity)
-	err = json.NewDecoder(r.Body).Decode(entity)
-	entity.SetID(id)
-	ctx := appengine.NewContext(r)
 	if err = resource.Validate(ctx, r, entity); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(err)
+		resource.fail(w, err, http.StatusUnprocessableEntity)
 		return
 	}
-	repository := datastore.NewDefaultRepositoryWithSignal(ctx, resource.Kind, resource.GetSignal())
 	err = repository.Update(entity)
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusInternalServerError)
+		resource.fail(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -201,21 +588,21 @@ func (resource Resource) Put(w http.ResponseWriter, r *http.Request) {
 
 // Delete deletes a resource
 func (resource Resource) Delete(w http.ResponseWriter, r *http.Request) {
-
-	var id int64
-	_, err := fmt.Sscanf(r.URL.Query().Get(":"+resource.Kind), "%d", &id)
+	entity := resource.newEntity()
+	err := resource.identify(r, entity)
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusBadRequest)
+		resource.fail(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx := resource.Context(r)
+	repository, err := resource.repository(ctx, r)
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
 		return
 	}
-	entity := reflect.New(resource.GetPrototype()).Interface().(Entity)
-	entity.SetID(id)
-	ctx := appengine.NewContext(r)
-
-	repository := datastore.NewDefaultRepositoryWithSignal(ctx, resource.Kind, resource.GetSignal())
 	err = repository.Delete(entity)
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusInternalServerError)
+		resource.fail(w, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -223,37 +610,48 @@ func (resource Resource) Delete(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// Post creates a resource
+// Post creates a resource. If CreatePrototype is set, the request is decoded
+// into a new CreatePrototype which is mapped onto a new entity
 func (resource Resource) Post(w http.ResponseWriter, r *http.Request) {
-	entity := reflect.New(resource.GetPrototype()).Interface().(Entity)
-
+	entity := resource.newEntity()
+	var input interface{} = entity
+	if resource.CreatePrototype != nil {
+		input = newValue(resource.CreatePrototype)
+	}
 	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(entity)
+	err := decoder.Decode(input)
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusBadRequest)
+		resource.fail(w, err, http.StatusBadRequest)
+		return
+	}
+	if input != entity {
+		if err = mapValue(entity, input); err != nil {
+			resource.fail(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	ctx := resource.Context(r)
+	repository, err := resource.repository(ctx, r)
+	if err != nil {
+		resource.fail(w, err, http.StatusInternalServerError)
 		return
 	}
-	ctx := appengine.NewContext(r)
-
-	repository := datastore.NewDefaultRepositoryWithSignal(ctx, resource.Kind, resource.GetSignal())
 	if err = resource.Validate(ctx, r, entity); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(err)
+		resource.fail(w, err, http.StatusUnprocessableEntity)
 		return
 	}
 	err = repository.Create(entity.(Entity))
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusInternalServerError)
+		resource.fail(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
-	type Created struct {
-		Status  int
-		Message string
-		ID      int64
+	message := CreatedMessage{Status: 201, Message: "Created", ID: entity.GetID()}
+	if named, ok := entity.(datastore.NamedEntity); ok {
+		message.Name = named.GetName()
 	}
-	err = json.NewEncoder(w).Encode(CreatedMessage{Status: 201, Message: "Created", ID: entity.(Entity).GetID()})
+	err = json.NewEncoder(w).Encode(message)
 	if err != nil {
-		resource.GetErrorFunction()(w, err, http.StatusInternalServerError)
+		resource.fail(w, err, http.StatusInternalServerError)
 	}
 }
@@ -20,14 +20,20 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/context"
 
+	appengine_datastore "github.com/Mparaiso/appengine/datastore"
+	_ "github.com/Mparaiso/appengine/datastore/datastoretest"
 	"github.com/Mparaiso/appengine/utils"
 	"github.com/Mparaiso/go-tiger/test"
 	"github.com/Mparaiso/go-tiger/validator"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
 )
 
 type TestUser struct {
@@ -76,6 +82,9 @@ func TestResource(t *testing.T) {
 	test.Fatal(t, err, nil)
 	defer instance.Close()
 	SubTestResourcePost(t, instance)
+	SubTestResourceParentKeyResolver(t, instance)
+	SubTestResourcePrototypes(t, instance)
+	SubTestTypedResource(t, instance)
 
 }
 
@@ -99,14 +108,17 @@ func SubTestResourcePost(t *testing.T, instance aetest.Instance) {
 	SubTestResourcePost400(t, instance, resource)
 	SubTestEndPointGet(t, instance, message.ID, resource)
 	SubTestEndPointIndex(t, instance, resource)
+	SubTestEndPointIndexPagination(t, instance, resource)
+	SubTestEndPointIndexQuery(t, instance, resource)
 	SubTestEndPointPut(t, instance, resource, message.ID)
+	SubTestEndPointPatch(t, instance, resource, message.ID)
 	SubTestEndPointDelete(t, instance, resource, message.ID)
 }
 
 // Given an resource
 // When "/" POST is required with an invalid entity
-// it responds with 400
-// it responds with an error message
+// it responds with 422
+// it responds with the field errors
 func SubTestResourcePost400(t *testing.T, instance aetest.Instance, resource *utils.Resource) {
 	buffer := new(bytes.Buffer)
 	user := &TestUser{Username: "johndoe", PlainPassword: "password"}
@@ -116,7 +128,8 @@ func SubTestResourcePost400(t *testing.T, instance aetest.Instance, resource *ut
 	test.Fatal(t, err, nil)
 	response := httptest.NewRecorder()
 	resource.Post(response, request)
-	test.Fatal(t, response.Code, http.StatusBadRequest)
+	test.Fatal(t, response.Code, http.StatusUnprocessableEntity)
+	test.Error(t, response.Header().Get("Content-Type"), utils.ProblemContentType)
 	message := &struct{ Errors struct{ Email []string } }{}
 	err = json.NewDecoder(response.Body).Decode(message)
 	test.Fatal(t, err, nil)
@@ -148,6 +161,125 @@ func SubTestEndPointIndex(t *testing.T, instance aetest.Instance, resource *util
 	err = json.NewDecoder(response.Body).Decode(&message)
 	test.Fatal(t, err, nil)
 	test.Fatal(t, len(message), 1, "[]*TestUser should have 1 element")
+	test.Fatal(t, response.Header().Get(utils.CursorHeader), "", "there should be no next page")
+}
+
+// Given a resource with ResultPerPage set to 1
+// When Index is requested
+// It should respond with 1 entity and the cursor of the next page in a header
+// When Index is requested with that cursor
+// It should respond with the next entity
+func SubTestEndPointIndexPagination(t *testing.T, instance aetest.Instance, resource *utils.Resource) {
+	buffer := new(bytes.Buffer)
+	err := json.NewEncoder(buffer).Encode(&TestUser{Username: "janedoe", Email: "janedoe@example.com"})
+	test.Fatal(t, err, nil)
+	request, err := instance.NewRequest("POST", "/", buffer)
+	test.Fatal(t, err, nil)
+	response := httptest.NewRecorder()
+	resource.Post(response, request)
+	test.Fatal(t, response.Code, http.StatusCreated)
+
+	resource.ResultPerPage = 1
+	defer func() { resource.ResultPerPage = 0 }()
+	request, err = instance.NewRequest("GET", "/", nil)
+	test.Fatal(t, err, nil)
+	response = httptest.NewRecorder()
+	resource.Index(response, request)
+	test.Fatal(t, response.Code, 200)
+	first := []*TestUser{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&first), nil)
+	test.Fatal(t, len(first), 1)
+	cursor := response.Header().Get(utils.CursorHeader)
+	test.Fatal(t, cursor != "", true, "first page should have a cursor")
+	test.Error(t, response.Header().Get("Link"), fmt.Sprintf(`</?cursor=%s>; rel="next"`, url.QueryEscape(cursor)))
+
+	request, err = instance.NewRequest("GET", "/?cursor="+url.QueryEscape(cursor), nil)
+	test.Fatal(t, err, nil)
+	response = httptest.NewRecorder()
+	resource.Index(response, request)
+	test.Fatal(t, response.Code, 200)
+	second := []*TestUser{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&second), nil)
+	test.Fatal(t, len(second), 1)
+	test.Error(t, second[0].ID != first[0].ID, true, "pages should not overlap")
+
+	request, err = instance.NewRequest("GET", "/?cursor=invalid", nil)
+	test.Fatal(t, err, nil)
+	response = httptest.NewRecorder()
+	resource.Index(response, request)
+	test.Fatal(t, response.Code, http.StatusBadRequest)
+}
+
+// Given a resource with filterable, sortable and selectable fields
+// When Index is requested with a filter
+// It should only list the matching entities
+// When Index is requested with fields
+// It should only encode the selected fields
+func SubTestEndPointIndexQuery(t *testing.T, instance aetest.Instance, resource *utils.Resource) {
+	resource.FilterableFields = []string{"Username"}
+	resource.SortableFields = []string{"Username"}
+	resource.SelectableFields = []string{"Username"}
+	request, err := instance.NewRequest("GET", "/?filter[Username]=janedoe&sort=-Username", nil)
+	test.Fatal(t, err, nil)
+	response := httptest.NewRecorder()
+	resource.Index(response, request)
+	test.Fatal(t, response.Code, 200)
+	page := []*TestUser{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&page), nil)
+	test.Fatal(t, len(page), 1)
+	test.Error(t, page[0].Username, "janedoe")
+
+	request, err = instance.NewRequest("GET", "/?fields=Username", nil)
+	test.Fatal(t, err, nil)
+	response = httptest.NewRecorder()
+	resource.Index(response, request)
+	test.Fatal(t, response.Code, 200)
+	sparse := []map[string]interface{}{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&sparse), nil)
+	test.Fatal(t, len(sparse) > 0, true)
+	test.Error(t, len(sparse[0]), 1, "only Username should be encoded")
+}
+
+// Given a resource
+// When Index is requested with invalid query string parameters
+// It should respond with 400 and an error for each parameter
+func TestResource_Index_InvalidParameters(t *testing.T) {
+	resource := utils.NewResource(&TestUser{}, "users")
+	resource.FilterableFields = []string{"ID"}
+	resource.ResultPerPage = 10
+	request := httptest.NewRequest("GET", "/?filter[Email]=john&filter[ID]=abc&filter[ID][like]=1&sort=Email&limit=20", nil)
+	response := httptest.NewRecorder()
+	resource.Index(response, request)
+	test.Fatal(t, response.Code, http.StatusBadRequest)
+	test.Error(t, response.Header().Get("Content-Type"), utils.ProblemContentType)
+	message := &struct{ Errors map[string][]string }{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(message), nil)
+	for _, parameter := range []string{"filter[Email]", "filter[ID]", "filter[ID][like]", "sort", "limit"} {
+		test.Error(t, len(message.Errors[parameter]), 1, parameter+" should have 1 error")
+	}
+}
+
+// Given a resource
+// When Index is requested with filters and sorts the datastore cannot run
+// It should respond with 400 and an error for the filter or sort parameter
+func TestResource_Index_InvalidInequalities(t *testing.T) {
+	resource := utils.NewResource(&TestUser{}, "users")
+	resource.FilterableFields = []string{"ID", "Username"}
+	resource.SortableFields = []string{"ID", "Username"}
+	for query, parameter := range map[string]string{
+		"/?filter[ID][gt]=1&filter[Username][lt]=john":  "filter",
+		"/?filter[ID][gt]=1&sort=Username":              "sort",
+		"/?filter[Username][ne]=john&sort=-ID,Username": "sort",
+	} {
+		response := httptest.NewRecorder()
+		resource.Index(response, httptest.NewRequest("GET", query, nil))
+		test.Fatal(t, response.Code, http.StatusBadRequest, query)
+		message := &struct{ Errors map[string][]string }{}
+		test.Fatal(t, json.NewDecoder(response.Body).Decode(message), nil)
+		test.Error(t, len(message.Errors[parameter]), 1, query)
+	}
+	_, err := resource.ParseQuery(url.Values{"filter[ID][gte]": {"1"}, "filter[ID][lt]": {"5"}, "sort": {"-ID,Username"}})
+	test.Error(t, err, nil, "inequalities on the first sorted field should be valid")
 }
 
 func SubTestEndPointPut(t *testing.T, instance aetest.Instance, resource *utils.Resource, ID int64) {
@@ -171,6 +303,38 @@ func SubTestEndPointPut(t *testing.T, instance aetest.Instance, resource *utils.
 	test.Fatal(t, message.Username, user.Username)
 }
 
+// Given a resource
+// When Patch is requested with a merge patch
+// It should only update the patched fields
+// When Patch is requested with a failing JSON patch test
+// It should respond with 409
+func SubTestEndPointPatch(t *testing.T, instance aetest.Instance, resource *utils.Resource, ID int64) {
+	body := bytes.NewBufferString(`{"Email":"patched@example.com"}`)
+	request, err := instance.NewRequest("PATCH", fmt.Sprintf("/?:users=%d", ID), body)
+	test.Fatal(t, err, nil)
+	request.Header.Set("Content-Type", utils.MergePatchContentType)
+	response := httptest.NewRecorder()
+	resource.Patch(response, request)
+	test.Fatal(t, response.Code, 200, "PATCH response should be 200")
+
+	request, err = instance.NewRequest("GET", fmt.Sprintf("/?:users=%d", ID), nil)
+	test.Fatal(t, err, nil)
+	response = httptest.NewRecorder()
+	resource.Get(response, request)
+	user := &TestUser{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(user), nil)
+	test.Error(t, user.Email, "patched@example.com")
+	test.Error(t, user.Username, "jackdoe", "fields missing from the patch should be kept")
+
+	body = bytes.NewBufferString(`[{"op":"test","path":"/Username","value":"johndoe"},{"op":"replace","path":"/Username","value":"janedoe"}]`)
+	request, err = instance.NewRequest("PATCH", fmt.Sprintf("/?:users=%d", ID), body)
+	test.Fatal(t, err, nil)
+	request.Header.Set("Content-Type", utils.JSONPatchContentType)
+	response = httptest.NewRecorder()
+	resource.Patch(response, request)
+	test.Fatal(t, response.Code, http.StatusConflict)
+}
+
 // Given an resource
 // When Delete is requested with an ID
 // It should respond with 200
@@ -190,6 +354,49 @@ func SubTestEndPointDelete(t *testing.T, instance aetest.Instance, resource *uti
 
 }
 
+// Given a resource with a ParentKeyResolver
+// When an entity is posted under an existing parent
+// It should be listed under that parent
+// When the parent does not exist
+// It should respond with 404
+func SubTestResourceParentKeyResolver(t *testing.T, instance aetest.Instance) {
+	request, err := instance.NewRequest("GET", "/", nil)
+	test.Fatal(t, err, nil)
+	ctx := appengine.NewContext(request)
+	projectKey, err := datastore.Put(ctx, datastore.NewKey(ctx, "projects", "", 1, nil), &struct{ Name string }{"project"})
+	test.Fatal(t, err, nil)
+	resource := utils.NewResource(&TestUser{}, "members")
+	resource.ParentKeyResolver = func(ctx context.Context, r *http.Request) (*datastore.Key, error) {
+		var id int64
+		if _, err := fmt.Sscanf(r.URL.Query().Get(":projects"), "%d", &id); err != nil {
+			return nil, err
+		}
+		return datastore.NewKey(ctx, "projects", "", id, nil), nil
+	}
+	buffer := new(bytes.Buffer)
+	test.Fatal(t, json.NewEncoder(buffer).Encode(&TestUser{Username: "member", Email: "member@example.com"}), nil)
+	request, err = instance.NewRequest("POST", fmt.Sprintf("/?:projects=%d", projectKey.IntID()), buffer)
+	test.Fatal(t, err, nil)
+	response := httptest.NewRecorder()
+	resource.Post(response, request)
+	test.Fatal(t, response.Code, http.StatusCreated)
+
+	request, err = instance.NewRequest("GET", fmt.Sprintf("/?:projects=%d", projectKey.IntID()), nil)
+	test.Fatal(t, err, nil)
+	response = httptest.NewRecorder()
+	resource.Index(response, request)
+	test.Fatal(t, response.Code, http.StatusOK)
+	page := []*TestUser{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&page), nil)
+	test.Fatal(t, len(page), 1, "the member should be listed under its project")
+
+	request, err = instance.NewRequest("GET", "/?:projects=2", nil)
+	test.Fatal(t, err, nil)
+	response = httptest.NewRecorder()
+	resource.Index(response, request)
+	test.Fatal(t, response.Code, http.StatusNotFound)
+}
+
 // LogFunc the name of the test function
 func LogFunc(t *testing.T) {
 	// ptr, _, _, ok := runtime.Caller(1)
@@ -197,3 +404,289 @@ func LogFunc(t *testing.T) {
 	// 	t.Log(runtime.FuncForPC(ptr).Name(), "\n")
 	// }
 }
+
+// Given a resource with a CreatePrototype, an UpdatePrototype and an OutputPrototype
+// When an entity is created
+// It should not let clients set the ID
+// When the entity is fetched
+// It should not expose the PlainPassword
+// When the entity is updated
+// It should only update the fields of the UpdatePrototype
+func SubTestResourcePrototypes(t *testing.T, instance aetest.Instance) {
+	resource := utils.NewResource(&TestUser{}, "users")
+	resource.SetCreatePrototype(&TestUserInput{})
+	resource.SetUpdatePrototype(&struct{ Email string }{})
+	resource.SetOutputPrototype(&TestUserOutput{})
+
+	body := bytes.NewBufferString(`{"ID":1234,"Username":"dtodoe","Email":"dtodoe@example.com","PlainPassword":"secret"}`)
+	request, err := instance.NewRequest("POST", "/", body)
+	test.Fatal(t, err, nil)
+	response := httptest.NewRecorder()
+	resource.Post(response, request)
+	test.Fatal(t, response.Code, http.StatusCreated)
+	message := &utils.CreatedMessage{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(message), nil)
+	test.Error(t, message.ID != 1234, true, "the ID should not be set by the client")
+
+	body = bytes.NewBufferString(`{"Username":"hacked","Email":"dtodoe@example.org"}`)
+	request, err = instance.NewRequest("PUT", fmt.Sprintf("/?:users=%d", message.ID), body)
+	test.Fatal(t, err, nil)
+	response = httptest.NewRecorder()
+	resource.Put(response, request)
+	test.Fatal(t, response.Code, http.StatusOK)
+
+	request, err = instance.NewRequest("GET", fmt.Sprintf("/?:users=%d", message.ID), nil)
+	test.Fatal(t, err, nil)
+	response = httptest.NewRecorder()
+	resource.Get(response, request)
+	test.Fatal(t, response.Code, http.StatusOK)
+	output := map[string]interface{}{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&output), nil)
+	_, ok := output["PlainPassword"]
+	test.Error(t, ok, false, "PlainPassword should not be exposed")
+	test.Error(t, output["Username"], "dtodoe", "Username is not a field of the UpdatePrototype")
+	test.Error(t, output["Email"], "dtodoe@example.org")
+}
+
+// Given a TypedResource
+// When an entity is created and the entities are listed
+// It should use the typed validator and return the entities
+func SubTestTypedResource(t *testing.T, instance aetest.Instance) {
+	resource := utils.NewTypedResource(func() *TestUser { return &TestUser{} }, "users")
+	validated := 0
+	resource.SetValidator(func(ctx context.Context, r *http.Request, user *TestUser) error {
+		validated++
+		return nil
+	})
+	request, err := instance.NewRequest("POST", "/", bytes.NewBufferString(`{"Username":"typeddoe"}`))
+	test.Fatal(t, err, nil)
+	response := httptest.NewRecorder()
+	resource.ServeHTTP(response, request)
+	test.Fatal(t, response.Code, http.StatusCreated)
+	test.Error(t, validated, 1)
+
+	request, err = instance.NewRequest("GET", "/?filter[Username]=typeddoe", nil)
+	test.Fatal(t, err, nil)
+	resource.FilterableFields = []string{"Username"}
+	response = httptest.NewRecorder()
+	resource.ServeHTTP(response, request)
+	test.Fatal(t, response.Code, http.StatusOK)
+	page := []*TestUser{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&page), nil)
+	test.Fatal(t, len(page), 1)
+	test.Error(t, page[0].Username, "typeddoe")
+}
+
+// newInMemoryResource returns a resource backed by in-memory repositories sharing store
+func newInMemoryResource(store *appengine_datastore.MemoryStore) *utils.Resource {
+	resource := utils.NewResource(&TestUser{}, "users")
+	resource.ContextFactory = appengine_datastore.ContextFactoryFunc(func(r *http.Request) context.Context {
+		return context.Background()
+	})
+	resource.RepositoryFactory = func(r *http.Request) (appengine_datastore.Repository, error) {
+		repository := appengine_datastore.NewInMemoryRepositoryWithSignal(context.Background(), resource.Kind, resource.GetSignal())
+		repository.Store = store
+		return repository, nil
+	}
+	return resource
+}
+
+// Given a resource with a RepositoryFactory and a ContextFactory
+// When entities are created, fetched, listed, updated and deleted
+// It should use the repositories of the factory
+func TestResource_RepositoryFactory(t *testing.T) {
+	store := appengine_datastore.NewMemoryStore()
+	resource := newInMemoryResource(store)
+	created := 0
+	resource.GetSignal().Add(appengine_datastore.ListenerFunc(func(e appengine_datastore.Event) error {
+		if _, ok := e.(appengine_datastore.AfterEntityCreatedEvent); ok {
+			created++
+		}
+		return nil
+	}))
+	response := httptest.NewRecorder()
+	resource.Post(response, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"Username":"johndoe","Email":"johndoe@example.com"}`)))
+	test.Fatal(t, response.Code, http.StatusCreated)
+	test.Error(t, created, 1, "listeners of the resource signal should be called")
+	message := &utils.CreatedMessage{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(message), nil)
+
+	response = httptest.NewRecorder()
+	resource.Put(response, httptest.NewRequest("PUT", fmt.Sprintf("/?:users=%d", message.ID), bytes.NewBufferString(`{"Username":"janedoe","Email":"janedoe@example.com"}`)))
+	test.Fatal(t, response.Code, http.StatusOK)
+
+	request := httptest.NewRequest("PATCH", fmt.Sprintf("/?:users=%d", message.ID), bytes.NewBufferString(`{"Email":"jane@example.com"}`))
+	request.Header.Set("Content-Type", utils.MergePatchContentType)
+	response = httptest.NewRecorder()
+	resource.Patch(response, request)
+	test.Fatal(t, response.Code, http.StatusOK)
+
+	response = httptest.NewRecorder()
+	resource.Get(response, httptest.NewRequest("GET", fmt.Sprintf("/?:users=%d", message.ID), nil))
+	test.Fatal(t, response.Code, http.StatusOK)
+	user := &TestUser{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(user), nil)
+	test.Error(t, user.Username, "janedoe")
+	test.Error(t, user.Email, "jane@example.com")
+
+	response = httptest.NewRecorder()
+	resource.Index(response, httptest.NewRequest("GET", "/", nil))
+	test.Fatal(t, response.Code, http.StatusOK)
+	page := []*TestUser{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&page), nil)
+	test.Error(t, len(page), 1)
+
+	response = httptest.NewRecorder()
+	resource.Delete(response, httptest.NewRequest("DELETE", fmt.Sprintf("/?:users=%d", message.ID), nil))
+	test.Fatal(t, response.Code, http.StatusOK)
+	response = httptest.NewRecorder()
+	resource.Get(response, httptest.NewRequest("GET", fmt.Sprintf("/?:users=%d", message.ID), nil))
+	test.Error(t, response.Code, http.StatusNotFound)
+}
+
+// Given a paginated resource
+// When Index is filtered with a multi-valued in or with ne
+// It should list the matching entities page by page
+func TestResource_Index_InNe(t *testing.T) {
+	store := appengine_datastore.NewMemoryStore()
+	resource := newInMemoryResource(store)
+	resource.ResultPerPage = 1
+	resource.FilterableFields = []string{"Username"}
+	resource.SortableFields = []string{"Username"}
+	users := appengine_datastore.NewInMemoryRepository(context.Background(), "users")
+	users.Store = store
+	for _, username := range []string{"janedoe", "johndoe", "jackdoe"} {
+		test.Fatal(t, users.Create(&TestUser{Username: username}), nil)
+	}
+	for query, expected := range map[string]string{
+		"/?filter[Username][in]=janedoe,johndoe&sort=Username": "janedoe,johndoe",
+		"/?filter[Username][ne]=janedoe&sort=Username":         "jackdoe,johndoe",
+	} {
+		usernames, cursor := []string{}, ""
+		for i := 0; i < 3; i++ {
+			response := httptest.NewRecorder()
+			resource.Index(response, httptest.NewRequest("GET", query+"&cursor="+url.QueryEscape(cursor), nil))
+			test.Fatal(t, response.Code, http.StatusOK, query)
+			page := []*TestUser{}
+			test.Fatal(t, json.NewDecoder(response.Body).Decode(&page), nil)
+			for _, user := range page {
+				usernames = append(usernames, user.Username)
+			}
+			if cursor = response.Header().Get(utils.CursorHeader); cursor == "" {
+				break
+			}
+		}
+		test.Error(t, strings.Join(usernames, ","), expected, query)
+	}
+}
+
+// Given a resource with a RepositoryFactory and a ParentKeyResolver
+// When the parent entity exists
+// The entities should be scoped to the parent entity
+// When the parent entity does not exist
+// It should respond with 404
+// When the parent ID is invalid
+// It should respond with 400
+func TestResource_RepositoryFactory_ParentKeyResolver(t *testing.T) {
+	store := appengine_datastore.NewMemoryStore()
+	projects := appengine_datastore.NewInMemoryRepository(context.Background(), "projects")
+	projects.Store = store
+	project := &TestUser{Username: "project"}
+	test.Fatal(t, projects.Create(project), nil)
+	resource := newInMemoryResource(store)
+	resource.ParentKeyResolver = func(ctx context.Context, r *http.Request) (*datastore.Key, error) {
+		var id int64
+		if _, err := fmt.Sscanf(r.URL.Query().Get(":projects"), "%d", &id); err != nil {
+			return nil, err
+		}
+		return datastore.NewKey(ctx, "projects", "", id, nil), nil
+	}
+	response := httptest.NewRecorder()
+	resource.Post(response, httptest.NewRequest("POST", fmt.Sprintf("/?:projects=%d", project.ID), bytes.NewBufferString(`{"Username":"member"}`)))
+	test.Fatal(t, response.Code, http.StatusCreated)
+
+	response = httptest.NewRecorder()
+	resource.Index(response, httptest.NewRequest("GET", fmt.Sprintf("/?:projects=%d", project.ID), nil))
+	test.Fatal(t, response.Code, http.StatusOK)
+	page := []*TestUser{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&page), nil)
+	test.Fatal(t, len(page), 1, "the member should be listed under its project")
+
+	response = httptest.NewRecorder()
+	resource.Index(response, httptest.NewRequest("GET", fmt.Sprintf("/?:projects=%d", project.ID+1000), nil))
+	test.Error(t, response.Code, http.StatusNotFound)
+
+	response = httptest.NewRecorder()
+	resource.Index(response, httptest.NewRequest("GET", "/?:projects=abc", nil))
+	test.Error(t, response.Code, http.StatusBadRequest)
+}
+
+type TestArticle struct {
+	ID     int64
+	Title  string
+	Author appengine_datastore.Ref[*TestUser]
+}
+
+// GetID returns a int64
+func (testArticle TestArticle) GetID() int64 {
+	return testArticle.ID
+}
+
+// SetID sets *TestArticle.ID
+func (testArticle *TestArticle) SetID(ID int64) {
+	testArticle.ID = ID
+}
+
+// Given a resource with includable fields
+// When an entity is fetched or listed with the include parameter
+// The referenced entities should be embedded
+// When a field that is not includable is included
+// It should respond with 400
+func TestResource_Include(t *testing.T) {
+	store := appengine_datastore.NewMemoryStore()
+	users := appengine_datastore.NewInMemoryRepository(context.Background(), "users")
+	users.Store = store
+	author := &TestUser{Username: "johndoe"}
+	test.Fatal(t, users.Create(author), nil)
+	posts := appengine_datastore.NewInMemoryRepository(context.Background(), "posts")
+	posts.Store = store
+	post := &TestArticle{Title: "Title", Author: appengine_datastore.NewRef[*TestUser](users.Key(author))}
+	test.Fatal(t, posts.Create(post), nil)
+	resource := utils.NewResource(&TestArticle{}, "posts")
+	resource.IncludableFields = []string{"Author"}
+	resource.ContextFactory = appengine_datastore.ContextFactoryFunc(func(r *http.Request) context.Context {
+		return context.Background()
+	})
+	resource.RepositoryFactory = func(r *http.Request) (appengine_datastore.Repository, error) {
+		repository := appengine_datastore.NewInMemoryRepositoryWithSignal(context.Background(), resource.Kind, resource.GetSignal())
+		repository.Store = store
+		return repository, nil
+	}
+
+	response := httptest.NewRecorder()
+	resource.Get(response, httptest.NewRequest("GET", fmt.Sprintf("/?:posts=%d&include=author", post.ID), nil))
+	test.Fatal(t, response.Code, http.StatusOK)
+	found := &TestArticle{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(found), nil)
+	test.Fatal(t, found.Author.Entity != nil, true, "the author should be embedded")
+	test.Error(t, found.Author.Entity.Username, "johndoe")
+
+	response = httptest.NewRecorder()
+	resource.Index(response, httptest.NewRequest("GET", "/?include=Author", nil))
+	test.Fatal(t, response.Code, http.StatusOK)
+	page := []*TestArticle{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(&page), nil)
+	test.Fatal(t, len(page), 1)
+	test.Error(t, page[0].Author.Entity != nil && page[0].Author.Entity.Username == "johndoe", true)
+
+	response = httptest.NewRecorder()
+	resource.Get(response, httptest.NewRequest("GET", fmt.Sprintf("/?:posts=%d", post.ID), nil))
+	test.Fatal(t, response.Code, http.StatusOK)
+	found = &TestArticle{}
+	test.Fatal(t, json.NewDecoder(response.Body).Decode(found), nil)
+	test.Error(t, found.Author.Entity == nil, true, "the author should not be embedded unless included")
+
+	response = httptest.NewRecorder()
+	resource.Index(response, httptest.NewRequest("GET", "/?include=Title", nil))
+	test.Error(t, response.Code, http.StatusBadRequest)
+}
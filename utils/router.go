@@ -0,0 +1,106 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// IDExtractor returns the ID or the name of the entity of a request, or an empty string
+// if the request targets the collection. param is the name of the route parameter, the Kind of the resource.
+// Adapters for other routers are one line functions :
+//
+//	// gorilla/mux
+//	func(r *http.Request, param string) string { return mux.Vars(r)[param] }
+//	// chi
+//	func(r *http.Request, param string) string { return chi.URLParam(r, param) }
+//	// httprouter
+//	func(r *http.Request, param string) string { return httprouter.ParamsFromContext(r.Context()).ByName(param) }
+type IDExtractor func(r *http.Request, param string) string
+
+// DefaultIDExtractor reads the {param} wildcard of a http.ServeMux pattern,
+// then the pat style ":param" query parameter
+func DefaultIDExtractor(r *http.Request, param string) string {
+	if id := r.PathValue(param); id != "" {
+		return id
+	}
+	return r.URL.Query().Get(":" + param)
+}
+
+// GetIDExtractor returns resource.IDExtractor, DefaultIDExtractor if not set
+func (resource Resource) GetIDExtractor() IDExtractor {
+	if resource.IDExtractor == nil {
+		return DefaultIDExtractor
+	}
+	return resource.IDExtractor
+}
+
+// SetIDExtractor sets resource.IDExtractor
+func (resource *Resource) SetIDExtractor(IDExtractor IDExtractor) {
+	resource.IDExtractor = IDExtractor
+}
+
+// Mount registers the handlers of the resource on mux with method patterns :
+//
+//	GET prefix, POST prefix, GET prefix/{kind}, PUT prefix/{kind}, PATCH prefix/{kind}, DELETE prefix/{kind}
+//
+// Kind must be a valid wildcard name. The handlers read the resource on each request,
+// so that the resource can still be configured after it is mounted.
+func (resource *Resource) Mount(mux *http.ServeMux, prefix string) {
+	// the signal and the prototype are shared by the copies of the resource made by each request
+	resource.GetSignal()
+	resource.GetPrototype()
+	collection := strings.TrimSuffix(prefix, "/")
+	item := collection + "/{" + resource.Kind + "}"
+	if collection == "" {
+		collection = "/{$}"
+	}
+	mux.HandleFunc("GET "+collection, func(w http.ResponseWriter, r *http.Request) { resource.Index(w, r) })
+	mux.HandleFunc("POST "+collection, func(w http.ResponseWriter, r *http.Request) { resource.Post(w, r) })
+	mux.HandleFunc("GET "+item, func(w http.ResponseWriter, r *http.Request) { resource.Get(w, r) })
+	mux.HandleFunc("PUT "+item, func(w http.ResponseWriter, r *http.Request) { resource.Put(w, r) })
+	mux.HandleFunc("PATCH "+item, func(w http.ResponseWriter, r *http.Request) { resource.Patch(w, r) })
+	mux.HandleFunc("DELETE "+item, func(w http.ResponseWriter, r *http.Request) { resource.Delete(w, r) })
+}
+
+// ServeHTTP dispatches a request to the handler of its method, so that a resource
+// can be registered on any router as a single http.Handler, the ID of the entity
+// being read by the IDExtractor
+func (resource Resource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hasID := resource.GetIDExtractor()(r, resource.Kind) != ""
+	switch {
+	case r.Method == "GET" && !hasID:
+		resource.Index(w, r)
+	case r.Method == "POST" && !hasID:
+		resource.Post(w, r)
+	case r.Method == "GET" && hasID:
+		resource.Get(w, r)
+	case r.Method == "PUT" && hasID:
+		resource.Put(w, r)
+	case r.Method == "PATCH" && hasID:
+		resource.Patch(w, r)
+	case r.Method == "DELETE" && hasID:
+		resource.Delete(w, r)
+	default:
+		if hasID {
+			w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		} else {
+			w.Header().Set("Allow", "GET, POST")
+		}
+		resource.fail(w, fmt.Errorf("Method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+	}
+}
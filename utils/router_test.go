@@ -0,0 +1,115 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Mparaiso/appengine/datastore"
+	"github.com/Mparaiso/appengine/utils"
+	"github.com/Mparaiso/go-tiger/test"
+)
+
+// Given a http.ServeMux pattern with a wildcard or a pat style query parameter
+// DefaultIDExtractor should return the ID
+func TestDefaultIDExtractor(t *testing.T) {
+	var id string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/{users}", func(w http.ResponseWriter, r *http.Request) {
+		id = utils.DefaultIDExtractor(r, "users")
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/10", nil))
+	test.Error(t, id, "10")
+	test.Error(t, utils.DefaultIDExtractor(httptest.NewRequest("GET", "/?:users=20", nil), "users"), "20")
+	test.Error(t, utils.DefaultIDExtractor(httptest.NewRequest("GET", "/", nil), "users"), "")
+}
+
+// Given a resource mounted on a http.ServeMux
+// When the collection is requested
+// It should be handled by Index
+// When a method is not allowed
+// It should respond with 405
+// When the resource is configured after it is mounted
+// It should use the new configuration
+func TestResource_Mount(t *testing.T) {
+	resource := utils.NewResource(&TestUser{}, "users")
+	mux := http.NewServeMux()
+	resource.Mount(mux, "/users/")
+
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest("GET", "/users?limit=abc", nil))
+	test.Error(t, response.Code, http.StatusBadRequest, "invalid Index parameters should be rejected")
+
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest("POST", "/users/1", nil))
+	test.Error(t, response.Code, http.StatusMethodNotAllowed)
+
+	resource.ErrorFunction = func(w http.ResponseWriter, err error, status int) {
+		w.WriteHeader(http.StatusTeapot)
+	}
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest("GET", "/users?limit=abc", nil))
+	test.Error(t, response.Code, http.StatusTeapot, "the resource should be configurable after it is mounted")
+}
+
+// Given a resource with a custom IDExtractor
+// When ServeHTTP is called
+// It should dispatch the request according to its method and ID
+func TestResource_ServeHTTP(t *testing.T) {
+	resource := utils.NewResource(&TestUser{}, "users")
+	resource.SetIDExtractor(func(r *http.Request, param string) string {
+		return r.Header.Get("X-" + param)
+	})
+
+	response := httptest.NewRecorder()
+	resource.ServeHTTP(response, httptest.NewRequest("GET", "/?limit=abc", nil))
+	test.Error(t, response.Code, http.StatusBadRequest, "the request should be handled by Index")
+
+	response = httptest.NewRecorder()
+	resource.ServeHTTP(response, httptest.NewRequest("DELETE", "/", nil))
+	test.Error(t, response.Code, http.StatusMethodNotAllowed)
+	test.Error(t, response.Header().Get("Allow"), "GET, POST")
+
+	request := httptest.NewRequest("POST", "/", nil)
+	request.Header.Set("X-users", "1")
+	response = httptest.NewRecorder()
+	resource.ServeHTTP(response, request)
+	test.Error(t, response.Code, http.StatusMethodNotAllowed)
+	test.Error(t, response.Header().Get("Allow"), "GET, PUT, PATCH, DELETE")
+}
+
+// Given a resource serving concurrent requests
+// When its signal is used concurrently
+// It should not race, run with go test -race
+func TestResource_Concurrency(t *testing.T) {
+	resource := &utils.Resource{Prototype: &TestUser{}, Kind: "users"}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resource.GetSignal().Add(datastore.NamedListenerFunc("listener", func(datastore.Event) error { return nil }))
+		}()
+		go func() {
+			defer wg.Done()
+			resource.GetPrototype()
+			test.Error(t, resource.GetSignal().Dispatch(struct{}{}), nil)
+		}()
+	}
+	wg.Wait()
+}
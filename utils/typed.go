@@ -0,0 +1,55 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"github.com/Mparaiso/appengine/datastore"
+)
+
+// TypedResource is a Resource of entities of type T, such as *Article,
+// its handlers create entities with a factory rather than with reflection
+type TypedResource[T Entity] struct {
+	*Resource
+	new func() T
+}
+
+// NewTypedResource creates a TypedResource, newEntity creates new entities of type T
+func NewTypedResource[T Entity](newEntity func() T, Kind string) *TypedResource[T] {
+	resource := NewResource(newEntity(), Kind)
+	resource.factory = func() Entity { return newEntity() }
+	resource.sliceFactory = func() interface{} { return &[]T{} }
+	return &TypedResource[T]{Resource: resource, new: newEntity}
+}
+
+// SetValidator sets a type safe validator
+func (resource *TypedResource[T]) SetValidator(validator func(ctx context.Context, r *http.Request, entity T) error) {
+	resource.Resource.SetValidator(func(ctx context.Context, r *http.Request, entity Entity) error {
+		return validator(ctx, r, entity.(T))
+	})
+}
+
+// Repository returns a TypedRepository scoped to the parent key of the request, like the
+// repositories of the handlers, for handlers written on top of the resource
+func (resource TypedResource[T]) Repository(ctx context.Context, r *http.Request) (*datastore.TypedRepository[T], error) {
+	repository, err := resource.Resource.repository(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewTypedRepository(repository, resource.new), nil
+}
@@ -1 +1,66 @@
 package validator_test
+
+import (
+	"testing"
+
+	"github.com/Mparaiso/appengine/datastore"
+	_ "github.com/Mparaiso/appengine/datastore/datastoretest"
+	"github.com/Mparaiso/appengine/validator"
+	"github.com/Mparaiso/go-tiger/test"
+	"golang.org/x/net/context"
+)
+
+type User struct {
+	ID       int64
+	Username string
+}
+
+func (user User) GetID() int64 {
+	return user.ID
+}
+
+func (user *User) SetID(id int64) {
+	user.ID = id
+}
+
+// Errors collects validation errors
+type Errors map[string][]string
+
+func (errors Errors) Append(key, value string) {
+	errors[key] = append(errors[key], value)
+}
+
+// Given a user
+// When a user with the same username is validated
+// It should append an error
+// When a user with another username is validated
+// It should not append an error
+func TestUniqueEntityValidator(t *testing.T) {
+	repository := datastore.NewInMemoryRepository(context.Background(), "users")
+	test.Fatal(t, repository.Create(&User{Username: "johndoe"}), nil)
+	unique := validator.NewUniqueEntityValidator(repository)
+
+	errors := Errors{}
+	unique.Validate("Username", map[string]interface{}{"Username": "johndoe"}, errors)
+	test.Error(t, len(errors["Username"]), 1)
+	errors = Errors{}
+	unique.Validate("Username", map[string]interface{}{"Username": "janedoe"}, errors)
+	test.Error(t, len(errors), 0)
+}
+
+// Given a user
+// When the user is validated
+// It should not append an error
+// When a missing user is validated
+// It should append an error
+func TestEntityExistsValidator(t *testing.T) {
+	repository := datastore.NewInMemoryRepository(context.Background(), "users")
+	test.Fatal(t, repository.Create(&User{Username: "johndoe"}), nil)
+	exists := validator.NewEntityExistsValidator(repository)
+
+	errors := Errors{}
+	exists.Validate("Author", "users", map[string]interface{}{"Username": "johndoe"}, errors)
+	test.Error(t, len(errors), 0)
+	exists.Validate("Author", "users", map[string]interface{}{"Username": "janedoe"}, errors)
+	test.Error(t, len(errors["Author"]), 1)
+}